@@ -0,0 +1,464 @@
+package hypercloud
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	hcc "github.com/TheHyperCloud/hypercloud-go-client/hypercloud"
+)
+
+// Tests for the behaviour of the vendored client the provider relies on
+
+func TestClientListFollowsLinkHeaders(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Query().Get("page") {
+		case "":
+			w.Header().Set("Link", `</api/v1/instances?page=2>; rel="next", </api/v1/instances?page=3>; rel="last"`)
+			fmt.Fprint(w, `[{"id": "a"}, {"id": "b", "name": "second"}]`)
+		case "2":
+			w.Header().Set("Link", fmt.Sprintf(`<%s/api/v1/instances?page=3>; rel="next"`, "http://"+r.Host))
+			fmt.Fprint(w, `[{"id": "c"}]`)
+		case "3":
+			fmt.Fprint(w, `[]`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	hc, _ := hcc.NewHypercloud(server.URL, "token")
+	instances, err := hc.InstanceList()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	var ids []string
+	for _, i := range instances {
+		ids = append(ids, i.ID)
+	}
+	if fmt.Sprint(ids) != "[a b c]" {
+		t.Fatalf("Expected instances [a b c] across all pages, got %v", ids)
+	}
+	if instances[0].Name != "" || instances[1].Name != "second" {
+		t.Fatalf("Fields leaked between decoded objects: %+v", instances)
+	}
+
+	it := hc.List("/instances?page=99")
+	defer it.Close()
+	var instance hcc.Instance
+	if it.Next(&instance) || !hcc.IsNotFound(it.Err()) {
+		t.Fatalf("Expected a not found error, got %v", it.Err())
+	}
+}
+
+func TestClientLogsRedactSecrets(t *testing.T) {
+	var response string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, response)
+	}))
+	defer server.Close()
+	hc, _ := hcc.NewHypercloud(server.URL, "TOKEN-SECRET")
+	hc.SetExtraHeaders(map[string]string{"X-Tenant": "acme", "X-Tenant-Token": "TENANT-SECRET", "X-Api-Key": "API-KEY-SECRET"})
+
+	var buf bytes.Buffer
+	log.SetOutput(&buf)
+	defer log.SetOutput(os.Stderr)
+
+	cases := []struct {
+		name     string
+		body     interface{}
+		response string
+		secrets  []string
+		kept     []string
+	}{
+		{"nested private key", map[string]interface{}{"public_key": map[string]interface{}{"name": "deploy", "private_key": "PRIVATE-SECRET"}},
+			`{"id": "key"}`, []string{"PRIVATE-SECRET"}, []string{"deploy", `"id":"key"`}},
+		{"password in a list", nil, `{"id": "console", "sessions": [{"host": "vnc.example", "password": "CONSOLE-SECRET"}]}`,
+			[]string{"CONSOLE-SECRET"}, []string{"vnc.example"}},
+		{"any key naming a secret", map[string]interface{}{"client_secret": "CLIENT-SECRET", "Password": "MIXED-CASE-SECRET"},
+			`{}`, []string{"CLIENT-SECRET", "MIXED-CASE-SECRET"}, nil},
+		{"not JSON", nil, `<html>Bad gateway</html>`, nil, []string{"<html>Bad gateway</html>"}},
+	}
+	for _, c := range cases {
+		buf.Reset()
+		response = c.response
+		hc.Request("POST", "/things", c.body)
+		logged := buf.String()
+
+		//The bearer token and extra headers are in every request
+		for _, secret := range append(c.secrets, "TOKEN-SECRET", "TENANT-SECRET", "API-KEY-SECRET") {
+			if strings.Contains(logged, secret) {
+				t.Errorf("%s: %s was logged: %s", c.name, secret, logged)
+			}
+		}
+		for _, kept := range c.kept {
+			if !strings.Contains(logged, kept) {
+				t.Errorf("%s: expected %s to be logged: %s", c.name, kept, logged)
+			}
+		}
+		if !strings.Contains(logged, "Authorization: <redacted>") || !strings.Contains(logged, "X-Tenant: acme") {
+			t.Errorf("%s: expected only the secret headers to be redacted: %s", c.name, logged)
+		}
+	}
+}
+
+func TestClientResponses(t *testing.T) {
+	type response struct {
+		status int
+		body   string
+	}
+	responses := map[string]response{
+		"/api/v1/instances/no-content":  {http.StatusNoContent, ""},
+		"/api/v1/instances/empty":       {http.StatusOK, ""},
+		"/api/v1/instances/not-found":   {http.StatusNotFound, `{"error": "not_found", "error_description": "No such instance"}`},
+		"/api/v1/instances/html":        {http.StatusBadGateway, "<html>\n<body><h1>502 Bad Gateway</h1></body>\n</html>"},
+		"/api/v1/instances/plain":       {http.StatusServiceUnavailable, "upstream connect error"},
+		"/api/v1/instances/bad-json":    {http.StatusOK, `{"id": `},
+		"/api/v1/instances/html-200":    {http.StatusOK, "<html>Log in</html>"},
+		"/api/v1/instances/empty-error": {http.StatusInternalServerError, ""},
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		resp, ok := responses[r.URL.Path]
+		if !ok {
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL)
+			http.NotFound(w, r)
+			return
+		}
+		w.WriteHeader(resp.status)
+		fmt.Fprint(w, resp.body)
+	}))
+	defer server.Close()
+	hc, _ := hcc.NewHypercloud(server.URL, "token")
+	hc.SetRetryPolicy(0, 0)
+
+	cases := []struct {
+		name    string
+		call    func() error
+		status  int    //Expected APIError status, 0 for none
+		errPart string //Expected in the error message, "" for no error
+	}{
+		{"204 on delete", func() error { return hc.InstanceDelete("no-content") }, 0, ""},
+		{"empty 200", func() error { _, err := hc.InstanceInfo("empty"); return err }, 0, ""},
+		{"empty 200 untyped", func() error { _, err := hc.Request("GET", "/instances/empty", nil); return err }, 0, ""},
+		{"JSON error", func() error { _, err := hc.InstanceInfo("not-found"); return err }, 404, "not_found (No such instance)"},
+		{"HTML error", func() error { _, err := hc.InstanceInfo("html"); return err }, 502, "<html> <body><h1>502 Bad Gateway</h1>"},
+		{"plain text error", func() error { return hc.InstanceDelete("plain") }, 503, "upstream connect error"},
+		{"empty error", func() error { _, err := hc.InstanceInfo("empty-error"); return err }, 500, "returned 500"},
+		{"truncated JSON", func() error { _, err := hc.InstanceInfo("bad-json"); return err }, 0, "Unable to decode the response to GET"},
+		{"HTML success", func() error { _, err := hc.Request("GET", "/instances/html-200", nil); return err }, 0, "200 OK"},
+		{"unencodable body", func() error {
+			_, err := hc.Request("POST", "/instances/never-sent", map[string]interface{}{"c": make(chan int)})
+			return err
+		}, 0, "Unable to encode the body of POST /instances/never-sent"},
+	}
+	for _, c := range cases {
+		err := c.call()
+		if c.errPart == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", c.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), c.errPart) {
+			t.Errorf("%s: expected error containing %q, got %v", c.name, c.errPart, err)
+			continue
+		}
+		apiErr, ok := hcc.AsAPIError(err)
+		switch {
+		case c.status == 0 && ok:
+			t.Errorf("%s: expected a non-API error, got %#v", c.name, apiErr)
+		case c.status != 0 && !ok:
+			t.Errorf("%s: expected an APIError, got %#v", c.name, err)
+		case ok && apiErr.StatusCode != c.status:
+			t.Errorf("%s: expected status %d, got %d", c.name, c.status, apiErr.StatusCode)
+		}
+	}
+
+	_, err := hc.InstanceInfo("html")
+	if apiErr, _ := hcc.AsAPIError(err); apiErr == nil || apiErr.Body != responses["/api/v1/instances/html"].body {
+		t.Fatalf("Expected the raw HTML body to be kept, got %#v", err)
+	}
+}
+
+func TestClientRetriesCreatesWithTheSameIdempotencyKey(t *testing.T) {
+	var keys []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Method+" "+r.Header.Get("Idempotency-Key"))
+		//Fail every other request, as if the gateway timed out
+		if len(keys)%2 == 1 {
+			w.WriteHeader(http.StatusGatewayTimeout)
+			return
+		}
+		fmt.Fprint(w, `{"id": "created"}`)
+	}))
+	defer server.Close()
+	hc, _ := hcc.NewHypercloud(server.URL, "token")
+	hc.SetRetryPolicy(1, time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		if _, err := hc.InstanceAssemble(hcc.InstanceCreateRequest{Name: "test"}); err != nil {
+			t.Fatalf("err: %s", err)
+		}
+	}
+	if _, err := hc.InstanceInfo("created"); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	if len(keys) != 6 {
+		t.Fatalf("Expected every request to be retried once, got %v", keys)
+	}
+	if keys[0] == "POST " || keys[0] != keys[1] {
+		t.Fatalf("Expected a retried create to reuse its idempotency key, got %v", keys)
+	}
+	if keys[2] == keys[0] || keys[2] != keys[3] {
+		t.Fatalf("Expected each create to get its own idempotency key, got %v", keys)
+	}
+	if keys[4] != "GET " {
+		t.Fatalf("Expected no idempotency key on a GET, got %v", keys)
+	}
+}
+
+func TestClientRetriesListPages(t *testing.T) {
+	var hits []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits = append(hits, r.URL.RequestURI())
+		//Every page fails the first time
+		if len(hits)%2 == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		if r.URL.Query().Get("page") == "" {
+			w.Header().Set("Link", `</api/v1/instances?page=2>; rel="next"`)
+			fmt.Fprint(w, `[{"id": "a"}]`)
+			return
+		}
+		fmt.Fprint(w, `[{"id": "b"}]`)
+	}))
+	defer server.Close()
+	hc, _ := hcc.NewHypercloud(server.URL, "token")
+	hc.SetRetryPolicy(1, time.Millisecond)
+
+	instances, err := hc.InstanceList()
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	if len(instances) != 2 || len(hits) != 4 {
+		t.Fatalf("Expected both pages after a retry each, got %v from %v", instances, hits)
+	}
+
+	//Out of retries
+	hits = nil
+	hc.SetRetryPolicy(0, 0)
+	if _, err := hc.InstanceList(); err == nil || !strings.Contains(err.Error(), "503") {
+		t.Fatalf("Expected the 503 to be returned, got %v", err)
+	}
+}
+
+func TestClientRateLimitsRequests(t *testing.T) {
+	var mu sync.Mutex
+	inFlight, maxInFlight := 0, 0
+	delay := time.Duration(0)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		if inFlight++; inFlight > maxInFlight {
+			maxInFlight = inFlight
+		}
+		sleep := delay
+		mu.Unlock()
+
+		time.Sleep(sleep)
+		mu.Lock()
+		inFlight--
+		mu.Unlock()
+		fmt.Fprint(w, `{"id": "a", "state": "running"}`)
+	}))
+	defer server.Close()
+
+	run := func(hc hcc.Client, n int) time.Duration {
+		start := time.Now()
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if _, err := hc.InstanceInfo("a"); err != nil {
+					t.Errorf("err: %s", err)
+				}
+			}()
+		}
+		wg.Wait()
+		return time.Since(start)
+	}
+
+	//20 a second with no burst is one every 50ms, so the 9 after the first take at least 450ms.
+	//Only the lower bound is checked, as a slow machine can always take longer
+	hc, _ := hcc.NewHypercloud(server.URL, "token")
+	hc.SetRateLimit(20, 1)
+	if elapsed := run(hcc.ToHypercloud(hc), 10); elapsed < 400*time.Millisecond {
+		t.Fatalf("Expected 10 requests at 20 a second to take at least 450ms, took %s", elapsed)
+	}
+
+	hc, _ = hcc.NewHypercloud(server.URL, "token")
+	hc.SetMaxConcurrentRequests(2)
+	mu.Lock()
+	delay = 30 * time.Millisecond
+	mu.Unlock()
+	run(hcc.ToHypercloud(hc), 8)
+	if maxInFlight > 2 {
+		t.Fatalf("Expected at most 2 requests in flight, got %d", maxInFlight)
+	}
+}
+
+// Region codes are matched in any case, as the instance's region is compared to its code that way
+func TestClientRegionInfo(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/api/v1/regions":
+			fmt.Fprint(w, `[{"id": "9e9806d3-d542-4ef0-878a-588c49ffcf50", "code": "SY3"}]`)
+		case "/api/v1/regions/9e9806d3-d542-4ef0-878a-588c49ffcf50":
+			fmt.Fprint(w, `{"id": "9e9806d3-d542-4ef0-878a-588c49ffcf50", "code": "SY3"}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+	hc, _ := hcc.NewHypercloud(server.URL, "token")
+
+	for _, id := range []string{"SY3", "sy3", "Sy3", "9e9806d3-d542-4ef0-878a-588c49ffcf50"} {
+		if region, err := hc.RegionInfo(id); err != nil || region.ID != "9e9806d3-d542-4ef0-878a-588c49ffcf50" {
+			t.Errorf("Unable to resolve %s: %v, %v", id, region, err)
+		}
+	}
+	if _, err := hc.RegionInfo("SV2"); !hcc.IsNotFound(err) {
+		t.Fatalf("Expected an unknown region to be not found, got %v", err)
+	}
+}
+
+func TestClientCachesReferenceData(t *testing.T) {
+	var mu sync.Mutex
+	hits := 0
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits++
+		mu.Unlock()
+		if r.URL.Path != "/api/v1/regions" {
+			t.Errorf("Unexpected request %s %s", r.Method, r.URL)
+		}
+		fmt.Fprint(w, `[{"id": "9e9806d3-d542-4ef0-878a-588c49ffcf50", "code": "SY3"}]`)
+	}))
+	defer server.Close()
+	hc, _ := hcc.NewHypercloud(server.URL, "token")
+	hc.SetReferenceCacheTTL(time.Minute)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if region, err := hc.RegionInfo("SY3"); err != nil || region.ID != "9e9806d3-d542-4ef0-878a-588c49ffcf50" {
+				t.Errorf("Unable to resolve SY3: %v, %v", region, err)
+			}
+		}()
+	}
+	wg.Wait()
+	regions, _ := hc.RegionList()
+	regions[0].Code = "XXX"
+	if region, err := hc.RegionInfo("9e9806d3-d542-4ef0-878a-588c49ffcf50"); err != nil || region.Code != "SY3" {
+		t.Fatalf("Cached regions were changed by a caller: %v, %v", region, err)
+	}
+	if hits != 1 {
+		t.Fatalf("Expected the region list to be fetched once, got %d requests", hits)
+	}
+
+	hc.SetReferenceCacheTTL(time.Nanosecond)
+	hc.RegionList()
+	time.Sleep(time.Millisecond)
+	hc.RegionList()
+	if hits != 3 {
+		t.Fatalf("Expected the region list to be fetched again once expired, got %d requests", hits)
+	}
+}
+
+func TestClientWaitForInstance(t *testing.T) {
+	//A request abandoned by a timed out wait can still be handled while the next case runs
+	var mu sync.Mutex
+	var states []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if len(states) == 0 {
+			http.NotFound(w, r)
+			return
+		}
+		//An empty state is an empty 200
+		if states[0] != "" {
+			fmt.Fprintf(w, `{"id": "a", "state": %q}`, states[0])
+		}
+		if len(states) > 1 {
+			states = states[1:]
+		}
+	}))
+	defer server.Close()
+	hc, _ := hcc.NewHypercloud(server.URL, "token")
+	client := hcc.ToHypercloud(hc)
+
+	up := hcc.WaitOptions{
+		Pending:      []string{"initial", "provisioning"},
+		Target:       []string{"stopped"},
+		Failure:      []string{"error"},
+		Timeout:      time.Second,
+		PollInterval: time.Millisecond,
+	}
+	cases := []struct {
+		name    string
+		states  []string
+		opts    hcc.WaitOptions
+		last    string
+		errPart string
+	}{
+		{"reaches target", []string{"initial", "provisioning", "stopped"}, up, "stopped", ""},
+		{"failure state", []string{"provisioning", "error"}, up, "error", "entered state error"},
+		{"unexpected state", []string{"provisioning", "running"}, up, "running", "entered state running"},
+		{"timeout", []string{"provisioning"}, hcc.WaitOptions{Pending: up.Pending, Target: up.Target, Timeout: 20 * time.Millisecond,
+			PollInterval: time.Millisecond}, "provisioning", "Timed out after 20ms waiting for instance a to become stopped (last state: provisioning)"},
+		{"no target", []string{"updating", "updating", "running"}, hcc.WaitOptions{Pending: []string{"updating"}, Timeout: time.Second,
+			PollInterval: time.Millisecond}, "running", ""},
+		{"no pending", []string{"running", "stopping", "terminated"}, hcc.WaitOptions{Target: []string{"terminated"}, Timeout: time.Second,
+			PollInterval: time.Millisecond}, "terminated", ""},
+		{"not found", nil, hcc.WaitOptions{Target: []string{"terminated"}, TargetNotFound: true, Timeout: time.Second}, "", ""},
+		{"not found unexpectedly", nil, up, "", "returned 404"},
+		{"empty response", []string{""}, up, "", "Unable to read instance a: the API returned an empty response"},
+	}
+	for _, c := range cases {
+		mu.Lock()
+		states = c.states
+		mu.Unlock()
+		instance, err := hcc.WaitForInstance(client, "a", c.opts)
+		last := ""
+		if instance != nil {
+			last = instance.State
+		}
+		if last != c.last {
+			t.Errorf("%s: expected the last instance seen to be %q, got %q", c.name, c.last, last)
+		}
+		if c.errPart == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", c.name, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), c.errPart) {
+			t.Errorf("%s: expected error containing %q, got %v", c.name, c.errPart, err)
+		}
+		if c.name == "timeout" && !hcc.IsWaitTimeout(err) {
+			t.Errorf("%s: expected a *WaitTimeoutError, got %#v", c.name, err)
+		}
+	}
+}
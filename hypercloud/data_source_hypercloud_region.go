@@ -38,7 +38,7 @@ func dataSourceHypercloudRegionRead(d *schema.ResourceData, meta interface{}) er
 	if err != nil {
 		return fmt.Errorf("Unable to get regions: \n%v", err)
 	}
-	d.Set("name", region.(map[string]interface{})["name"].(string))
-	d.Set("code", region.(map[string]interface{})["code"].(string))
+	d.Set("name", region.Name)
+	d.Set("code", region.Code)
 	return nil
 }
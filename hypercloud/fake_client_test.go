@@ -0,0 +1,487 @@
+package hypercloud
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	hcc "github.com/TheHyperCloud/hypercloud-go-client/hypercloud"
+	"github.com/hashicorp/terraform/config"
+	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+// fakeCloud is the in-memory state shared by a fakeClient and its copies
+type fakeCloud struct {
+	mu        sync.Mutex
+	nextID    int
+	instances map[string]*hcc.Instance
+	regions   []hcc.Region
+	tiers     []hcc.PerformanceTier
+	disks     map[string]*hcc.Disk
+	ips       map[string]*hcc.IPAddress
+	keys      map[string]*hcc.PublicKey
+	calls     []string
+
+	//State new instances are created in, "stopped" if unset
+	createState string
+	//Provisioning instances become stopped the next time InstanceInfo reads them
+	readyOnInfo bool
+	//State deleted instances are left in, "terminated" if unset
+	deleteState string
+	//Calls by name (e.g. "InstanceUpdate") that fail with the given error
+	failures map[string]error
+
+	//Reads aren't in calls, only counted
+	infoCalls int
+	listCalls int
+}
+
+// fakeClient is an in-memory hcc.Client for unit testing resources without the API.
+// Operations it doesn't implement fall through to the nil embedded Client and panic,
+// so a test notices when a resource makes a call it didn't expect
+type fakeClient struct {
+	hcc.Client
+	*fakeCloud
+	ctx context.Context
+}
+
+// newFakeClient returns a fake with one region (SY3), one instance performance tier
+// and disks disk-1 and disk-2, IP address ip-1 and public keys key-1 and key-2 in that region
+func newFakeClient() *fakeClient {
+	sy3 := hcc.Region{ID: "9e9806d3-d542-4ef0-878a-588c49ffcf50", Name: "Sydney", Code: "SY3"}
+	return &fakeClient{
+		fakeCloud: &fakeCloud{
+			instances: make(map[string]*hcc.Instance),
+			regions:   []hcc.Region{sy3},
+			tiers: []hcc.PerformanceTier{
+				{ID: "55f841d6-7e19-4de9-be47-93f650ff9f9b", Name: "Standard", MinMemory: 512, MaxMemory: 16384},
+			},
+			disks: map[string]*hcc.Disk{
+				"disk-1": {ID: "disk-1", Region: &sy3},
+				"disk-2": {ID: "disk-2", Region: &sy3},
+			},
+			ips: map[string]*hcc.IPAddress{
+				"ip-1": {ID: "ip-1", Address: "203.0.113.1", Region: &sy3},
+			},
+			keys: map[string]*hcc.PublicKey{
+				"key-1": {ID: "key-1"},
+				"key-2": {ID: "key-2"},
+			},
+		},
+	}
+}
+
+func (f *fakeClient) record(format string, args ...interface{}) {
+	f.calls = append(f.calls, fmt.Sprintf(format, args...))
+}
+
+func (f *fakeClient) notFound(method, path string) error {
+	return &hcc.APIError{StatusCode: 404, Method: method, Path: "/api/v1" + path, Code: "not_found"}
+}
+
+func (f *fakeClient) WithContext(ctx context.Context) hcc.Client {
+	return &fakeClient{fakeCloud: f.fakeCloud, ctx: ctx}
+}
+
+func (f *fakeClient) Context() context.Context {
+	if f.ctx == nil {
+		return context.Background()
+	}
+	return f.ctx
+}
+
+func (f *fakeClient) DefaultRegion() string {
+	return "SY3"
+}
+
+func (f *fakeClient) RegionList() ([]hcc.Region, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]hcc.Region(nil), f.regions...), nil
+}
+
+func (f *fakeClient) RegionInfo(regionId string) (*hcc.Region, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, r := range f.regions {
+		if r.ID == regionId || strings.EqualFold(r.Code, regionId) {
+			region := r
+			return &region, nil
+		}
+	}
+	return nil, f.notFound("GET", "/regions/"+regionId)
+}
+
+func (f *fakeClient) PerformanceTierListInstance() ([]hcc.PerformanceTier, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]hcc.PerformanceTier(nil), f.tiers...), nil
+}
+
+func (f *fakeClient) DiskInfo(diskId string) (*hcc.Disk, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	disk, ok := f.disks[diskId]
+	if !ok {
+		return nil, f.notFound("GET", "/disks/"+diskId)
+	}
+	//A nil entry stands in for an empty API response
+	if disk == nil {
+		return nil, nil
+	}
+	ret := *disk
+	return &ret, nil
+}
+
+func (f *fakeClient) IPAddressInfo(IPAddrID string) (*hcc.IPAddress, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ip, ok := f.ips[IPAddrID]
+	if !ok {
+		return nil, f.notFound("GET", "/ip_addresses/"+IPAddrID)
+	}
+	if ip == nil {
+		return nil, nil
+	}
+	ret := *ip
+	return &ret, nil
+}
+
+func (f *fakeClient) PublicKeyInfo(pkId string) (*hcc.PublicKey, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key, ok := f.keys[pkId]
+	if !ok {
+		return nil, f.notFound("GET", "/public_keys/"+pkId)
+	}
+	ret := *key
+	return &ret, nil
+}
+
+func (f *fakeClient) InstanceAssemble(body hcc.InstanceCreateRequest) (*hcc.Instance, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("InstanceAssemble %s", body.Name)
+
+	f.nextID++
+	state := f.createState
+	if state == "" {
+		state = "stopped"
+	}
+	instance := &hcc.Instance{
+		ID:                fmt.Sprintf("instance-%d", f.nextID),
+		Name:              body.Name,
+		State:             state,
+		Memory:            body.Memory,
+		BootDevice:        body.BootDevice,
+		Virtualization:    body.Virtualization,
+		PerformanceTier:   &hcc.PerformanceTier{ID: body.PerformanceTier},
+		Region:            &hcc.Region{ID: body.Region},
+		AvailabilityGroup: body.AvailabilityGroup,
+		Tags:              body.Tags,
+		CreatedAt:         time.Now().UTC().Format(time.RFC3339),
+	}
+	if body.StartOnCrash != nil {
+		instance.StartOnCrash = *body.StartOnCrash
+	}
+	if body.StartOnReboot != nil {
+		instance.StartOnReboot = *body.StartOnReboot
+	}
+	if body.StartOnShutdown != nil {
+		instance.StartOnShutdown = *body.StartOnShutdown
+	}
+	for _, r := range f.regions {
+		if r.ID == body.Region {
+			region := r
+			instance.Region = &region
+		}
+	}
+	setFakeDisks(instance, body.Disks)
+	setFakePublicKeys(instance, body.PublicKeys)
+	if len(body.IPAddresses) > 0 {
+		setFakeNetworking(instance, []hcc.NetworkAdapterRequest{{IPAddresses: body.IPAddresses}})
+	}
+	f.instances[instance.ID] = instance
+
+	//Like a response lost on the way back, the instance is still created
+	if err := f.failures["InstanceAssemble"]; err != nil {
+		return nil, err
+	}
+	ret := *instance
+	return &ret, nil
+}
+
+func (f *fakeClient) InstanceInfo(instanceId string) (*hcc.Instance, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.infoCalls++
+	if err := f.failures["InstanceInfo"]; err != nil {
+		return nil, err
+	}
+	instance, ok := f.instances[instanceId]
+	if !ok {
+		return nil, f.notFound("GET", "/instances/"+instanceId)
+	}
+	if f.readyOnInfo && instance.State == "provisioning" {
+		instance.State = "stopped"
+	}
+	ret := *instance
+	return &ret, nil
+}
+
+func (f *fakeClient) InstanceList() ([]hcc.Instance, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.listCalls++
+	var ret []hcc.Instance
+	for _, instance := range f.instances {
+		ret = append(ret, *instance)
+	}
+	return ret, nil
+}
+
+// List iterates over the fake's instances, the only list endpoint it has
+func (f *fakeClient) List(path string) hcc.ListIterator {
+	if path != "/instances" {
+		return &fakeListIterator{err: f.notFound("GET", path)}
+	}
+	instances, err := f.InstanceList()
+	return &fakeListIterator{instances: instances, err: err}
+}
+
+type fakeListIterator struct {
+	instances []hcc.Instance
+	err       error
+}
+
+func (it *fakeListIterator) Next(out interface{}) bool {
+	if it.err != nil || len(it.instances) == 0 {
+		return false
+	}
+	*out.(*hcc.Instance) = it.instances[0]
+	it.instances = it.instances[1:]
+	return true
+}
+
+func (it *fakeListIterator) Err() error {
+	return it.err
+}
+
+func (it *fakeListIterator) Close() error {
+	it.instances = nil
+	return nil
+}
+
+func (f *fakeClient) InstanceUpdate(instanceId string, body hcc.InstanceUpdateRequest) (*hcc.Instance, error) {
+	return f.instanceUpdate("InstanceUpdate", instanceId, body)
+}
+
+func (f *fakeClient) InstanceUpdateDisks(instanceId string, disks []string) (*hcc.Instance, error) {
+	return f.instanceUpdate("InstanceUpdateDisks", instanceId, hcc.InstanceUpdateRequest{Disks: disks})
+}
+
+func (f *fakeClient) InstanceUpdatePublicKeys(instanceId string, publicKeys []string) (*hcc.Instance, error) {
+	return f.instanceUpdate("InstanceUpdatePublicKeys", instanceId, hcc.InstanceUpdateRequest{PublicKeys: publicKeys})
+}
+
+func (f *fakeClient) InstanceUpdateNetworking(instanceId string, adapters []hcc.NetworkAdapterRequest) (*hcc.Instance, error) {
+	return f.instanceUpdate("InstanceUpdateNetworking", instanceId, hcc.InstanceUpdateRequest{NetworkAdapters: adapters})
+}
+
+func (f *fakeClient) InstanceUpdateHighAvailability(instanceId string, group []string) (*hcc.Instance, error) {
+	return f.instanceUpdate("InstanceUpdateHighAvailability", instanceId, hcc.InstanceUpdateRequest{AvailabilityGroup: group})
+}
+
+func (f *fakeClient) instanceUpdate(call string, instanceId string, body hcc.InstanceUpdateRequest) (*hcc.Instance, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("%s %s", call, instanceId)
+	if err := f.failures[call]; err != nil {
+		return nil, err
+	}
+	instance, ok := f.instances[instanceId]
+	if !ok {
+		return nil, f.notFound("PUT", "/instances/"+instanceId)
+	}
+
+	if (body.Memory != nil || body.PerformanceTier != nil || body.Virtualization != nil) && instance.State != "stopped" {
+		return nil, &hcc.APIError{StatusCode: 409, Method: "PUT", Path: "/api/v1/instances/" + instanceId, Code: "instance_running"}
+	}
+	if body.Name != nil {
+		instance.Name = *body.Name
+	}
+	if body.Memory != nil {
+		instance.Memory = *body.Memory
+	}
+	if body.PerformanceTier != nil {
+		instance.PerformanceTier = &hcc.PerformanceTier{ID: *body.PerformanceTier}
+	}
+	if body.BootDevice != nil {
+		instance.BootDevice = *body.BootDevice
+	}
+	if body.Virtualization != nil {
+		instance.Virtualization = *body.Virtualization
+	}
+	if body.StartOnCrash != nil {
+		instance.StartOnCrash = *body.StartOnCrash
+	}
+	if body.StartOnReboot != nil {
+		instance.StartOnReboot = *body.StartOnReboot
+	}
+	if body.StartOnShutdown != nil {
+		instance.StartOnShutdown = *body.StartOnShutdown
+	}
+	if body.AvailabilityGroup != nil {
+		instance.AvailabilityGroup = body.AvailabilityGroup
+	}
+	if body.Disks != nil {
+		setFakeDisks(instance, body.Disks)
+	}
+	if body.NetworkAdapters != nil {
+		setFakeNetworking(instance, body.NetworkAdapters)
+	}
+	if body.PublicKeys != nil {
+		setFakePublicKeys(instance, body.PublicKeys)
+	}
+
+	ret := *instance
+	return &ret, nil
+}
+
+func (f *fakeClient) InstanceStart(instanceId string, body interface{}) (*hcc.Instance, error) {
+	return f.setState("InstanceStart", instanceId, "running")
+}
+
+func (f *fakeClient) InstanceStop(instanceId string, body interface{}) (*hcc.Instance, error) {
+	return f.setState("InstanceStop", instanceId, "stopped")
+}
+
+func (f *fakeClient) setState(call string, instanceId string, state string) (*hcc.Instance, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("%s %s", call, instanceId)
+	if err := f.failures[call]; err != nil {
+		return nil, err
+	}
+	instance, ok := f.instances[instanceId]
+	if !ok {
+		return nil, f.notFound("POST", "/instances/"+instanceId)
+	}
+	instance.State = state
+	ret := *instance
+	return &ret, nil
+}
+
+func (f *fakeClient) InstanceDelete(instanceId string) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.record("InstanceDelete %s", instanceId)
+	if err := f.failures["InstanceDelete"]; err != nil {
+		return err
+	}
+	instance, ok := f.instances[instanceId]
+	if !ok {
+		return f.notFound("DELETE", "/instances/"+instanceId)
+	}
+	instance.State = f.deleteState
+	if instance.State == "" {
+		instance.State = "terminated"
+	}
+	return nil
+}
+
+func setFakeDisks(instance *hcc.Instance, ids []string) {
+	instance.Disks = nil
+	for _, id := range ids {
+		instance.Disks = append(instance.Disks, hcc.Disk{ID: id})
+	}
+}
+
+func setFakePublicKeys(instance *hcc.Instance, ids []string) {
+	instance.PublicKeys = nil
+	for _, id := range ids {
+		instance.PublicKeys = append(instance.PublicKeys, hcc.PublicKey{ID: id})
+	}
+}
+
+func setFakeNetworking(instance *hcc.Instance, adapters []hcc.NetworkAdapterRequest) {
+	instance.NetworkAdapters = nil
+	for _, a := range adapters {
+		adapter := hcc.NetworkAdapter{}
+		for _, id := range a.IPAddresses {
+			adapter.IPAddresses = append(adapter.IPAddresses, hcc.IPAddress{ID: id})
+		}
+		instance.NetworkAdapters = append(instance.NetworkAdapters, adapter)
+	}
+}
+
+// testResourceApply plans raw against state and applies the result like `terraform apply` would
+func testResourceApply(t *testing.T, r *schema.Resource, state *terraform.InstanceState,
+	raw map[string]interface{}, meta interface{}) (*terraform.InstanceState, error) {
+	t.Helper()
+
+	c, err := config.NewRawConfig(raw)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	diff, err := r.Diff(state, terraform.NewResourceConfig(c), meta)
+	if err != nil {
+		return state, err
+	}
+	if diff == nil {
+		return state, nil
+	}
+	return r.Apply(state, diff, meta)
+}
+
+// testFakeInstance creates an instance with 4096MB, named "fake", plus attrs against a new fake.
+// It returns the fake, the resource, the config to change for updates and the created state
+func testFakeInstance(t *testing.T, attrs map[string]interface{}) (*fakeClient, *schema.Resource, map[string]interface{}, *terraform.InstanceState) {
+	t.Helper()
+	hc := newFakeClient()
+	r := resourceHypercloudInstance()
+	raw := map[string]interface{}{
+		"memory":           4096,
+		"name":             "fake",
+		"performance_tier": "55f841d6-7e19-4de9-be47-93f650ff9f9b",
+	}
+	for k, v := range attrs {
+		raw[k] = v
+	}
+	state, err := testResourceApply(t, r, nil, raw, hc)
+	if err != nil {
+		t.Fatalf("Create failed: %s", err)
+	}
+	return hc, r, raw, state
+}
+
+// testResourceDestroy applies a destroy diff to state
+func testResourceDestroy(r *schema.Resource, state *terraform.InstanceState, meta interface{}) (*terraform.InstanceState, error) {
+	return r.Apply(state, &terraform.InstanceDiff{Destroy: true}, meta)
+}
+
+func TestFakeClientList(t *testing.T) {
+	hc := newFakeClient()
+	hc.instances["a"] = &hcc.Instance{ID: "a"}
+	var client hcc.Client = hc
+
+	it := client.List("/instances")
+	defer it.Close()
+	var instance hcc.Instance
+	var ids []string
+	for it.Next(&instance) {
+		ids = append(ids, instance.ID)
+	}
+	if it.Err() != nil || fmt.Sprint(ids) != "[a]" {
+		t.Fatalf("Expected instance a, got %v, %v", ids, it.Err())
+	}
+
+	it = client.List("/disks")
+	if it.Next(&instance) || !hcc.IsNotFound(it.Err()) {
+		t.Fatalf("Expected a list the fake doesn't have to be not found, got %v", it.Err())
+	}
+}
@@ -0,0 +1,60 @@
+package hypercloud
+
+import (
+	"sync"
+)
+
+// instanceClaims records the instances this provider has created or adopted. Resources with identical
+// config have the same create tag, so without it one could adopt the instance another just created
+type instanceClaims struct {
+	mu      sync.Mutex
+	claimed map[string]bool
+	tags    map[string]*sync.Mutex
+}
+
+func newInstanceClaims() *instanceClaims {
+	return &instanceClaims{claimed: make(map[string]bool), tags: make(map[string]*sync.Mutex)}
+}
+
+// lock serializes creates with the same tag, so each claims its instance before the next looks for orphans.
+// It returns the unlock
+func (c *instanceClaims) lock(tag string) func() {
+	if c == nil {
+		return func() {}
+	}
+	c.mu.Lock()
+	l, ok := c.tags[tag]
+	if !ok {
+		l = &sync.Mutex{}
+		c.tags[tag] = l
+	}
+	c.mu.Unlock()
+	l.Lock()
+	return l.Unlock
+}
+
+func (c *instanceClaims) claim(id string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.claimed[id] = true
+}
+
+func (c *instanceClaims) isClaimed(id string) bool {
+	if c == nil {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.claimed[id]
+}
+
+// claimsOf returns the provider's instance claims, nil if meta isn't a *providerMeta
+func claimsOf(meta interface{}) *instanceClaims {
+	if m, ok := meta.(*providerMeta); ok {
+		return m.claims
+	}
+	return nil
+}
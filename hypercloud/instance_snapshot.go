@@ -0,0 +1,89 @@
+package hypercloud
+
+import (
+	"sync"
+	"time"
+
+	hcc "github.com/TheHyperCloud/hypercloud-go-client/hypercloud"
+)
+
+// providerMeta is what resources are handed as meta. It's an hcc.Client, plus the
+// instance snapshot when bulk_refresh is enabled and the instances created so far
+type providerMeta struct {
+	hcc.Client
+	instances *instanceSnapshot
+	claims    *instanceClaims
+}
+
+// instanceSnapshot serves instance reads from one InstanceList call, retaken once it's older than
+// window, instead of an InstanceInfo call per instance. Instances the provider has changed since the
+// snapshot was taken, or that aren't in it, are fetched individually
+type instanceSnapshot struct {
+	window time.Duration
+
+	mu        sync.Mutex
+	taken     time.Time
+	instances map[string]hcc.Instance
+	changed   map[string]time.Time
+}
+
+func newInstanceSnapshot(window time.Duration) *instanceSnapshot {
+	return &instanceSnapshot{window: window, changed: make(map[string]time.Time)}
+}
+
+// get returns the instance from the snapshot, taking a new one if it's stale.
+// ok is false if the caller should fetch the instance itself
+func (s *instanceSnapshot) get(hc hcc.Client, id string) (instance *hcc.Instance, ok bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.instances == nil || time.Since(s.taken) > s.window {
+		//Anything changed from here on is newer than the snapshot
+		taken := time.Now()
+		list, err := hc.InstanceList()
+		if err != nil {
+			return nil, false, err
+		}
+		s.instances = make(map[string]hcc.Instance, len(list))
+		for _, i := range list {
+			s.instances[i.ID] = i
+		}
+		s.taken = taken
+	}
+	if t, changed := s.changed[id]; changed && !t.Before(s.taken) {
+		return nil, false, nil
+	}
+	i, ok := s.instances[id]
+	if !ok {
+		return nil, false, nil
+	}
+	return &i, true, nil
+}
+
+// forget stops the snapshot serving id until a new one is taken
+func (s *instanceSnapshot) forget(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.changed[id] = time.Now()
+}
+
+// instanceInfo is hc.InstanceInfo, served from the bulk refresh snapshot when it's enabled
+func instanceInfo(meta interface{}, id string) (*hcc.Instance, error) {
+	hc := hcc.ToHypercloud(meta)
+	if m, ok := meta.(*providerMeta); ok && m.instances != nil {
+		instance, ok, err := m.instances.get(hc, id)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return instance, nil
+		}
+	}
+	return hc.InstanceInfo(id)
+}
+
+// instanceChanged must be called once the provider has changed an instance, so reads after it aren't served stale data
+func instanceChanged(meta interface{}, id string) {
+	if m, ok := meta.(*providerMeta); ok && m.instances != nil {
+		m.instances.forget(id)
+	}
+}
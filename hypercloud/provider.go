@@ -1,16 +1,31 @@
 package hypercloud
 
 import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
 	"fmt"
+	"net"
+	"net/url"
+	"runtime"
 	"strings"
+	"time"
 
 	hcc "github.com/TheHyperCloud/hypercloud-go-client/hypercloud"
 	"github.com/hashicorp/terraform/helper/schema"
+	"github.com/hashicorp/terraform/helper/validation"
 	"github.com/hashicorp/terraform/terraform"
+	"github.com/hashicorp/terraform/version"
 )
 
+// How long regions, performance tiers and templates are cached for. Long enough to cover a typical run
+const referenceCacheTTL = 5 * time.Minute
+
+// How long a bulk_refresh instance list is used before it's fetched again
+const bulkRefreshWindow = time.Minute
+
 func Provider() terraform.ResourceProvider {
-	return &schema.Provider{
+	p := &schema.Provider{
 		//Credentials in format <access_key>:<secret_key> or just <access_token>
 		Schema: map[string]*schema.Schema{
 			"credentials": &schema.Schema{
@@ -26,6 +41,58 @@ func Provider() terraform.ResourceProvider {
 				Description:  "The URL endpoint to access the hypercloud API",
 				ValidateFunc: validateBaseURL,
 			},
+			"region": &schema.Schema{
+				Type:        schema.TypeString,
+				Optional:    true,
+				DefaultFunc: schema.MultiEnvDefaultFunc([]string{"HC_REGION"}, ""),
+				Description: "Code (e.g. SY3) or ID of the region used by resources that don't specify their own",
+			},
+			"user_agent_suffix": &schema.Schema{
+				Type:        schema.TypeString,
+				Optional:    true,
+				DefaultFunc: schema.MultiEnvDefaultFunc([]string{"HC_USER_AGENT_SUFFIX"}, ""),
+				Description: "Appended to the User-Agent sent with every API request",
+			},
+			"extra_headers": &schema.Schema{
+				Type:     schema.TypeMap,
+				Optional: true,
+				Elem: &schema.Schema{
+					Type: schema.TypeString,
+				},
+				Description: "Additional HTTP headers to send with every API request",
+			},
+			"rate_limit": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				DefaultFunc:  schema.MultiEnvDefaultFunc([]string{"HC_RATE_LIMIT"}, 10),
+				ValidateFunc: validation.IntAtLeast(0),
+				Description:  "Maximum number of API requests per second across all resources. 0 disables the limit",
+			},
+			"max_concurrent_requests": &schema.Schema{
+				Type:         schema.TypeInt,
+				Optional:     true,
+				DefaultFunc:  schema.MultiEnvDefaultFunc([]string{"HC_MAX_CONCURRENT_REQUESTS"}, 8),
+				ValidateFunc: validation.IntAtLeast(0),
+				Description:  "Maximum number of API requests in flight at once. 0 disables the limit",
+			},
+			"disable_reference_cache": &schema.Schema{
+				Type:        schema.TypeBool,
+				Optional:    true,
+				DefaultFunc: schema.MultiEnvDefaultFunc([]string{"HC_DISABLE_REFERENCE_CACHE"}, false),
+				Description: "Fetch regions, performance tiers and templates every time they're needed rather than caching them for the run",
+			},
+			"bulk_refresh": &schema.Schema{
+				Type:        schema.TypeBool,
+				Optional:    true,
+				DefaultFunc: schema.MultiEnvDefaultFunc([]string{"HC_BULK_REFRESH"}, false),
+				Description: "Refresh instances from a single list of every instance in the account, rather than fetching each one. Faster for configurations with many instances",
+			},
+			"skip_credentials_validation": &schema.Schema{
+				Type:        schema.TypeBool,
+				Optional:    true,
+				DefaultFunc: schema.MultiEnvDefaultFunc([]string{"HC_SKIP_CREDENTIALS_VALIDATION"}, false),
+				Description: "Skip checking the credentials and base_url against the API when the provider is configured",
+			},
 		},
 		DataSourcesMap: map[string]*schema.Resource{
 			//"hypercloud_disk_performance_tier" : dataSourceHypercloudDiskPerformanceTier(),
@@ -40,23 +107,140 @@ func Provider() terraform.ResourceProvider {
 			//"hypercloud_ip_address" : resourceHypercloudIPAddress(),
 			//"hypercloud_public_key" : resourceHypercloudPublicKey(),
 		},
+	}
 
-		ConfigureFunc: initHyperCloud,
+	//Bind the client to the provider's stop context so Ctrl-C aborts in-flight requests and waits
+	p.ConfigureFunc = func(d *schema.ResourceData) (interface{}, error) {
+		return initHyperCloud(d, p.StopContext())
 	}
+	return p
 }
 
-func initHyperCloud(d *schema.ResourceData) (hc interface{}, err error) {
+// initHyperCloud returns the *providerMeta every resource is handed as meta
+func initHyperCloud(d *schema.ResourceData, stopCtx context.Context) (hc interface{}, err error) {
 	auth := d.Get("credentials").(string)
-	var mErr []error
-	hc, mErr = hcc.NewHypercloud(d.Get("base_url").(string), auth)
+	client, mErr := hcc.NewHypercloud(d.Get("base_url").(string), auth)
 	if mErr != nil {
 		err = fmt.Errorf("%v", mErr)
-	} else {
-		err = nil
+		return
+	}
+	client.SetDefaultRegion(d.Get("region").(string))
+	client.SetUserAgent(userAgent(d.Get("user_agent_suffix").(string)))
+
+	headers := make(map[string]string)
+	for k, v := range d.Get("extra_headers").(map[string]interface{}) {
+		headers[k] = v.(string)
+	}
+	client.SetExtraHeaders(headers)
+
+	client.SetRateLimit(float64(d.Get("rate_limit").(int)), 0)
+	client.SetMaxConcurrentRequests(d.Get("max_concurrent_requests").(int))
+	if !d.Get("disable_reference_cache").(bool) {
+		client.SetReferenceCacheTTL(referenceCacheTTL)
+	}
+
+	bound := client.WithContext(stopCtx)
+	if !d.Get("skip_credentials_validation").(bool) {
+		if err = validateCredentials(bound, d.Get("base_url").(string)); err != nil {
+			return
+		}
+	}
+
+	meta := &providerMeta{Client: bound, claims: newInstanceClaims()}
+	if d.Get("bulk_refresh").(bool) {
+		meta.instances = newInstanceSnapshot(bulkRefreshWindow)
 	}
+	hc = meta
 	return
 }
 
+// validateCredentials makes a cheap authenticated call so a bad base_url or token fails
+// at configuration time with a hint about what's wrong, rather than on the first resource
+func validateCredentials(hc hcc.Client, baseURL string) error {
+	_, err := hc.RegionList()
+	if err == nil {
+		return nil
+	}
+	if te, ok := err.(*hcc.TransportError); ok {
+		return transportErrorHint(baseURL, te)
+	}
+	_, isAPIError := hcc.AsAPIError(err)
+	switch {
+	case hcc.IsUnauthorized(err):
+		return fmt.Errorf("The HyperCloud API at %s rejected the credentials. "+
+			"Check the credentials setting (or HC_CREDENTIALS) holds a valid access token: \n%v", baseURL, err)
+	//Something other than an API response (e.g. a HTML page) means we're not talking to the API
+	case hcc.IsNotFound(err), !isAPIError:
+		return fmt.Errorf("%s doesn't look like a HyperCloud API endpoint (%s/api/v1/regions didn't return a region list). "+
+			"Check base_url is the API host without the /api/v1 path: \n%v", baseURL, baseURL, err)
+	}
+	return fmt.Errorf("Unable to validate HyperCloud credentials against %s. "+
+		"Set skip_credentials_validation to skip this check: \n%v", baseURL, err)
+}
+
+func transportErrorHint(baseURL string, te *hcc.TransportError) error {
+	err := te.Err
+	//Dig down to the root cause, e.g. *url.Error -> *net.OpError -> *net.DNSError
+	for {
+		if ue, ok := err.(*url.Error); ok {
+			err = ue.Err
+		} else if oe, ok := err.(*net.OpError); ok {
+			err = oe.Err
+		} else if we, ok := err.(interface {
+			Unwrap() error
+		}); ok && we.Unwrap() != nil {
+			err = we.Unwrap()
+		} else {
+			break
+		}
+	}
+	switch err.(type) {
+	case *net.DNSError:
+		return fmt.Errorf("Unable to resolve the host in base_url %s. Check the URL is spelled correctly: \n%v", baseURL, te)
+	case x509.UnknownAuthorityError, x509.HostnameError, x509.CertificateInvalidError, tls.RecordHeaderError:
+		return fmt.Errorf("TLS handshake with %s failed. Check base_url uses the right scheme and host, "+
+			"and that its certificate is trusted: \n%v", baseURL, te)
+	}
+	return fmt.Errorf("Unable to connect to the HyperCloud API at %s: \n%v", baseURL, te)
+}
+
+// userAgent identifies the provider and the Terraform SDK it was built with to the API, e.g.
+// "terraform-provider-hypercloud/1.0.1 terraform-sdk/0.11.0 (go1.9.2) <suffix>". The SDK is vendored
+// into the plugin, so this is not the version of the Terraform binary running it
+func userAgent(suffix string) string {
+	ua := fmt.Sprintf("terraform-provider-hypercloud/%s terraform-sdk/%s (%s)", ProviderVersion, version.String(), runtime.Version())
+	if suffix = strings.TrimSpace(suffix); suffix != "" {
+		ua += " " + suffix
+	}
+	return ua
+}
+
+// resourceGetter is implemented by both *schema.ResourceData and *schema.ResourceDiff
+type resourceGetter interface {
+	GetOk(key string) (interface{}, bool)
+}
+
+// getRegion returns the region ID for a region scoped resource, falling back to the
+// provider's default region if the resource doesn't set one. Region codes are resolved to IDs
+func getRegion(d resourceGetter, meta interface{}) (string, error) {
+	hc := hcc.ToHypercloud(meta)
+	region := hc.DefaultRegion()
+	if r, ok := d.GetOk("region"); ok {
+		region = r.(string)
+	}
+	if region == "" {
+		return "", fmt.Errorf("No region set. Specify a region on the resource or the provider")
+	}
+	if len(region) != 3 { //Already an ID
+		return region, nil
+	}
+	info, err := hc.RegionInfo(region)
+	if err != nil {
+		return "", fmt.Errorf("Unable to resolve region %s: \n%v", region, err)
+	}
+	return info.ID, nil
+}
+
 func validateBaseURL(v interface{}, k string) (warnings []string, errors []error) {
 	url := v.(string)
 	if len(url) == 0 {
@@ -1,12 +1,19 @@
 package hypercloud
 
 import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"os"
 	"strings"
 	"testing"
+	"time"
 
+	hcc "github.com/TheHyperCloud/hypercloud-go-client/hypercloud"
 	"github.com/hashicorp/terraform/helper/schema"
 	"github.com/hashicorp/terraform/terraform"
+	"github.com/hashicorp/terraform/version"
 )
 
 var testAccProviders map[string]terraform.ResourceProvider
@@ -34,3 +41,126 @@ func testAccPreCheck(t *testing.T) {
 		}
 	}
 }
+
+func TestUserAgent(t *testing.T) {
+	ua := userAgent("")
+	if !strings.Contains(ua, "terraform-provider-hypercloud/"+ProviderVersion) {
+		t.Fatalf("User agent %q is missing the provider version", ua)
+	}
+	if !strings.Contains(ua, "terraform-sdk/"+version.String()) {
+		t.Fatalf("User agent %q is missing the Terraform SDK version", ua)
+	}
+	if ua := userAgent(" ci-pipeline "); !strings.HasSuffix(ua, " ci-pipeline") {
+		t.Fatalf("User agent %q is missing the suffix", ua)
+	}
+}
+
+func TestValidateCredentials(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch {
+		case r.URL.Path != "/api/v1/regions":
+			http.NotFound(w, r)
+		case r.Header.Get("Authorization") != "Bearer good":
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"error": "invalid_token"}`))
+		default:
+			w.Write([]byte(`[{"id": "9e9806d3-d542-4ef0-878a-588c49ffcf50", "code": "SY3"}]`))
+		}
+	})
+	server := httptest.NewServer(handler)
+	defer server.Close()
+	tlsServer := httptest.NewTLSServer(handler)
+	defer tlsServer.Close()
+
+	cases := []struct {
+		baseURL string
+		token   string
+		errPart string
+	}{
+		{server.URL, "good", ""},
+		{server.URL, "bad", "rejected the credentials"},
+		{server.URL + "/api/v1", "good", "doesn't look like a HyperCloud API endpoint"},
+		{tlsServer.URL, "good", "TLS handshake"},
+		//.invalid is reserved so never resolves
+		{"https://hypercloud.invalid", "good", "Unable to resolve the host"},
+	}
+	for _, c := range cases {
+		hc, _ := hcc.NewHypercloud(c.baseURL, c.token)
+		err := validateCredentials(hcc.ToHypercloud(hc), c.baseURL)
+		if c.errPart == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %s", c.baseURL, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), c.errPart) {
+			t.Errorf("%s with token %q: expected error containing %q, got %v", c.baseURL, c.token, c.errPart, err)
+		}
+	}
+}
+
+// Ctrl-C stops Terraform through the provider's stop context, which must abort requests and waits in progress
+func TestProviderStopCancelsRequests(t *testing.T) {
+	arrived := make(chan string, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		arrived <- r.URL.Path
+		if r.URL.Path == "/api/v1/instances/blocked" {
+			//Never answers, until the client goes away
+			<-r.Context().Done()
+			return
+		}
+		fmt.Fprint(w, `{"id": "provisioning", "state": "provisioning"}`)
+	}))
+	defer server.Close()
+
+	newMeta := func() (hcc.Client, context.CancelFunc) {
+		d := schema.TestResourceDataRaw(t, Provider().(*schema.Provider).Schema, map[string]interface{}{
+			"base_url":                    server.URL,
+			"credentials":                 "token",
+			"skip_credentials_validation": true,
+		})
+		ctx, cancel := context.WithCancel(context.Background())
+		meta, err := initHyperCloud(d, ctx)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		return hcc.ToHypercloud(meta), cancel
+	}
+
+	hc, stop := newMeta()
+	errs := make(chan error, 1)
+	go func() {
+		_, err := hc.InstanceInfo("blocked")
+		errs <- err
+	}()
+	<-arrived
+	stop()
+	select {
+	case err := <-errs:
+		if err == nil {
+			t.Fatalf("Expected the request to fail once stopped")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Request still running after the provider was stopped")
+	}
+
+	hc, stop = newMeta()
+	go func() {
+		_, err := hcc.WaitForInstance(hc, "provisioning", hcc.WaitOptions{
+			Pending:      []string{"provisioning"},
+			Target:       []string{"stopped"},
+			PollInterval: time.Minute,
+		})
+		errs <- err
+	}()
+	<-arrived
+	stop()
+	select {
+	case err := <-errs:
+		if err == nil || !strings.Contains(err.Error(), "Stopped waiting for instance provisioning") {
+			t.Fatalf("Expected the wait to stop, got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Wait still running after the provider was stopped")
+	}
+}
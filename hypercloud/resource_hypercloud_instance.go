@@ -5,10 +5,17 @@
 package hypercloud
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
 	"fmt"
+	"log"
+	"strings"
 	"time"
 
 	hcc "github.com/TheHyperCloud/hypercloud-go-client/hypercloud"
+	"github.com/hashicorp/go-multierror"
+	"github.com/hashicorp/terraform/config"
 	"github.com/hashicorp/terraform/helper/schema"
 	"github.com/hashicorp/terraform/helper/validation"
 )
@@ -20,8 +27,20 @@ func resourceHypercloudInstance() *schema.Resource {
 		Update: resourceHypercloudInstanceUpdate,
 		Delete: resourceHypercloudInstanceDelete,
 		Exists: resourceHypercloudInstanceExists,
+		Importer: &schema.ResourceImporter{
+			State: resourceHypercloudInstanceImport,
+		},
+		CustomizeDiff: resourceHypercloudInstanceCustomizeDiff,
+
+		Timeouts: &schema.ResourceTimeout{
+			Create: schema.DefaultTimeout(20 * time.Minute),
+			Update: schema.DefaultTimeout(10 * time.Minute),
+			Delete: schema.DefaultTimeout(10 * time.Minute),
+		},
 
-		SchemaVersion: 1, //For API v1
+		//Version 2 stores availability_group, ip_addresses and public_keys as sets
+		SchemaVersion: 2,
+		MigrateState:  resourceHypercloudInstanceMigrateState,
 
 		Schema: map[string]*schema.Schema{
 			"memory": &schema.Schema{
@@ -38,22 +57,31 @@ func resourceHypercloudInstance() *schema.Resource {
 			"performance_tier": &schema.Schema{
 				Type:        schema.TypeString,
 				Required:    true,
-				ForceNew:    true,
-				Description: "ID of the performance tier to assign to the instance",
+				Description: "ID of the performance tier to assign to the instance. Changing it needs the instance stopped",
 			},
 			"region": &schema.Schema{
 				Type:        schema.TypeString,
-				Required:    true,
+				Optional:    true,
+				Computed:    true,
 				ForceNew:    true,
-				Description: "ID of the region in which to create the instance",
+				Description: "ID or code of the region in which to create the instance. Defaults to the provider's region",
+				//State holds the ID, which is the same region as its code. Codes match in any case, as in RegionInfo
+				DiffSuppressFunc: func(k, old, new string, d *schema.ResourceData) bool {
+					return strings.EqualFold(new, d.Get("region_code").(string))
+				},
+			},
+			"region_code": &schema.Schema{
+				Type:     schema.TypeString,
+				Computed: true,
 			},
 			"availability_group": &schema.Schema{
-				Type:     schema.TypeList,
+				Type:     schema.TypeSet,
 				Optional: true,
 				MaxItems: 2, //3 max in availiability group
 				Elem: &schema.Schema{
 					Type: schema.TypeString,
 				},
+				Set:         schema.HashString,
 				Description: "IDs of the instances that should be grouped together with the instance for high availability",
 			},
 			"boot_device": &schema.Schema{
@@ -72,19 +100,21 @@ func resourceHypercloudInstance() *schema.Resource {
 				Description: "IDs of disks to be attached to the instance, in device order",
 			},
 			"ip_addresses": &schema.Schema{
-				Type:     schema.TypeList,
+				Type:     schema.TypeSet,
 				Optional: true,
 				Elem: &schema.Schema{
 					Type: schema.TypeString,
 				},
+				Set:         schema.HashString,
 				Description: "IDs of IP addresses to be assigned to the instance",
 			},
 			"public_keys": &schema.Schema{
-				Type:     schema.TypeList,
+				Type:     schema.TypeSet,
 				Optional: true,
 				Elem: &schema.Schema{
 					Type: schema.TypeString,
 				},
+				Set:         schema.HashString,
 				Description: "IDs of public keys that can be used to access the instance",
 			},
 			"start_on_crash": &schema.Schema{
@@ -109,9 +139,15 @@ func resourceHypercloudInstance() *schema.Resource {
 				Type:         schema.TypeString,
 				Optional:     true,
 				Default:      "hvm",
-				ValidateFunc: validation.StringInSlice([]string{"disk", "cdrom", "network"}, false),
+				ValidateFunc: validation.StringInSlice([]string{"hvm", "pv"}, false),
 				Description:  "Virtualization mode. One of `hvm`, `pv`",
 			},
+			"allow_stopping_for_update": &schema.Schema{
+				Type:        schema.TypeBool,
+				Optional:    true,
+				Default:     false,
+				Description: "Allow Terraform to stop the instance to apply changes that need it stopped, starting it again afterwards",
+			},
 			"created_at": &schema.Schema{
 				Type:     schema.TypeString,
 				Computed: true,
@@ -148,118 +184,187 @@ func memoryValidation(i interface{}, k string) (s []string, es []error) {
 
 func resourceHypercloudInstanceCreate(d *schema.ResourceData, meta interface{}) error {
 	hc := hcc.ToHypercloud(meta)
-	requestData := make(map[string]interface{})
+	requestData := hcc.InstanceCreateRequest{}
 
 	/* Get the essentials (memory/name/performancetier/region) */
-	requestData["memory"] = d.Get("memory").(int)
-	requestData["name"] = d.Get("name").(string)
-	requestData["performance_tier"] = d.Get("performance_tier").(string)
-	requestData["region"] = d.Get("region").(string)
+	requestData.Memory = d.Get("memory").(int)
+	requestData.Name = d.Get("name").(string)
+	requestData.PerformanceTier = d.Get("performance_tier").(string)
+	region, err := getRegion(d, meta)
+	if err != nil {
+		return err
+	}
+	requestData.Region = region
 
 	/* Check for the other fields, if they exist, add them */
 	ag, exists := d.GetOk("availability_group")
 	if exists {
-		requestData["availability_group"] = ag.([]string)
+		requestData.AvailabilityGroup = expandStringList(ag.(*schema.Set).List())
 	}
 
 	bd, exists := d.GetOk("boot_device")
 	if exists {
-		requestData["boot_device"] = bd.(string)
+		requestData.BootDevice = bd.(string)
 	}
 
 	disks, exists := d.GetOk("disks")
 	if exists {
-		requestData["disks"] = disks.([]string)
+		requestData.Disks = expandStringList(disks.([]interface{}))
 	}
 
 	ipAddr, exists := d.GetOk("ip_addresses")
 	if exists {
-		requestData["ip_addresses"] = ipAddr.([]string)
+		requestData.IPAddresses = expandStringList(ipAddr.(*schema.Set).List())
 	}
 
-	startOnCrash, exists := d.GetOk("start_on_crash")
+	pks, exists := d.GetOk("public_keys")
 	if exists {
-		requestData["start_on_crash"] = startOnCrash.(bool)
+		requestData.PublicKeys = expandStringList(pks.(*schema.Set).List())
 	}
 
-	startOnReboot, exists := d.GetOk("start_on_reboot")
-	if exists {
-		requestData["start_on_reboot"] = startOnReboot.(bool)
-	}
+	//Bools are always sent, GetOk can't tell false from unset
+	startOnCrash := d.Get("start_on_crash").(bool)
+	requestData.StartOnCrash = &startOnCrash
 
-	startOnShutdown, exists := d.GetOk("start_on_shutdown")
-	if exists {
-		requestData["start_on_shutdown"] = startOnShutdown.(bool)
-	}
+	startOnReboot := d.Get("start_on_reboot").(bool)
+	requestData.StartOnReboot = &startOnReboot
+
+	startOnShutdown := d.Get("start_on_shutdown").(bool)
+	requestData.StartOnShutdown = &startOnShutdown
 
 	virtualization, exists := d.GetOk("virtualization")
 	if exists {
-		requestData["virtualization"] = virtualization.(string)
+		requestData.Virtualization = virtualization.(string)
 	}
 
-	createResponse, err := hc.InstanceAssemble(requestData)
+	createResponse, err := assembleInstance(meta, requestData, d.Timeout(schema.TimeoutCreate))
 	if err != nil {
-		return fmt.Errorf("%v", err)
+		return err
 	}
 
-	cr := createResponse.(map[string]interface{})
-	d.SetId(cr["id"].(string))
-
-	createTimeout, exists := d.GetOk("create_timeout")
-	if !exists {
-		createTimeout = 60 //1 min timeout might be too long (W H O K N O W S)
-	}
+	d.SetId(createResponse.ID)
 
 	/* Wait until the resource is "ready" i.e. stopped state */
-	waitErr := waitInstanceUp(hc, cr["id"].(string), createTimeout.(int))
+	waitErr := waitInstanceUp(hc, createResponse.ID, d.Timeout(schema.TimeoutCreate))
 	if waitErr != nil {
-		d.SetId("")
-		return waitErr
+		//The instance exists, so keep its ID. Terraform marks it tainted to be replaced or destroyed later
+		return fmt.Errorf("Instance %s was created but didn't become ready: \n%v", d.Id(), waitErr)
 	}
 
+	instanceChanged(meta, d.Id())
 	return resourceHypercloudInstanceRead(d, meta)
 }
 
-func resourceHypercloudInstanceRead(d *schema.ResourceData, meta interface{}) error {
+// instanceCreateTag identifies instances created by the provider from req. It's a hash of
+// the request, so a retry of the same create finds what the earlier attempt left behind
+func instanceCreateTag(req hcc.InstanceCreateRequest) string {
+	req.Tags = nil
+	body, _ := json.Marshal(req)
+	sum := sha256.Sum256(body)
+	return "terraform-create:" + hex.EncodeToString(sum[:16])
+}
+
+// assembleInstance creates the instance for req. If an earlier attempt timed out before the API answered,
+// the instance may exist without Terraform knowing its ID, so that's picked up rather than creating a duplicate
+func assembleInstance(meta interface{}, req hcc.InstanceCreateRequest, window time.Duration) (*hcc.Instance, error) {
 	hc := hcc.ToHypercloud(meta)
-	ret, err := hc.InstanceInfo(d.Id())
+	tag := instanceCreateTag(req)
+	req.Tags = []string{tag}
+
+	claims := claimsOf(meta)
+	unlock := claims.lock(tag)
+	defer unlock()
+
+	instance, err := findOrphanInstance(hc, req.Name, tag, window, claims)
 	if err != nil {
-		return fmt.Errorf("%v", err)
+		return nil, fmt.Errorf("Unable to check for an instance left by an earlier create: \n%v", err)
+	}
+	if instance != nil {
+		log.Printf("[INFO] Using instance %s left by an earlier create of %s", instance.ID, req.Name)
+	} else {
+		instance, err = hc.InstanceAssemble(req)
+		if err != nil {
+			return nil, fmt.Errorf("%v", err)
+		}
+		if instance == nil {
+			return nil, fmt.Errorf("Unable to create instance %s: the API returned an empty response", req.Name)
+		}
 	}
+	claims.claim(instance.ID)
+	return instance, nil
+}
 
-	instance := ret.(map[string]interface{})
+// findOrphanInstance returns the instance named name carrying tag that's still provisioning, was created
+// within window and isn't claimed by another resource, or nil if there isn't one. Anything else with the
+// tag may be managed by a resource with the same config
+func findOrphanInstance(hc hcc.Client, name string, tag string, window time.Duration, claims *instanceClaims) (*hcc.Instance, error) {
+	instances, err := hc.InstanceList()
+	if err != nil {
+		return nil, err
+	}
+	for i := range instances {
+		instance := &instances[i]
+		if instance.Name != name || !containsString(instanceProvisioningStates, instance.State) || claims.isClaimed(instance.ID) {
+			continue
+		}
+		created, err := time.Parse(time.RFC3339, instance.CreatedAt)
+		if err != nil || time.Since(created) > window {
+			continue
+		}
+		if containsString(instance.Tags, tag) {
+			return instance, nil
+		}
+	}
+	return nil, nil
+}
+
+func resourceHypercloudInstanceRead(d *schema.ResourceData, meta interface{}) error {
+	instance, err := instanceInfo(meta, d.Id())
+	if instanceGone(instance, err) {
+		log.Printf("[WARN] Instance %s no longer exists, removing it from state", d.Id())
+		d.SetId("")
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("Unable to read instance %s: \n%v", d.Id(), err)
+	}
+	if instance == nil {
+		return fmt.Errorf("Unable to read instance %s: the API returned an empty response", d.Id())
+	}
 
 	/* Lets fill out the form shall we? */
-	d.Set("memory", int(instance["memory"].(float64)))
-	d.Set("name", instance["name"].(string))
-	d.Set("performance_tier", instance["performance_tier"].(map[string]interface{})["id"].(string))
-	d.Set("region", instance["region"].(map[string]interface{})["id"].(string))
+	d.Set("memory", instance.Memory)
+	d.Set("name", instance.Name)
+	if instance.PerformanceTier != nil {
+		d.Set("performance_tier", instance.PerformanceTier.ID)
+	}
+	if instance.Region != nil {
+		d.Set("region", instance.Region.ID)
+		d.Set("region_code", instance.Region.Code)
+	}
 
 	/* Alrighty-o time to fill out the rest. */
 
 	//Availability group
-	d.Set("availability_group", instance["availability_group"].([]interface{})) //Should actually be []string but IDK what json's doing
+	d.Set("availability_group", instance.AvailabilityGroup)
 
 	//Boot device
-	d.Set("boot_device", instance["boot_device"].(string))
+	d.Set("boot_device", instance.BootDevice)
 
 	//Disks
 	//This one is trickier. Have to pull out the list of disk IDs
 	var mDisks []string
-	for _, disk := range instance["disks"].([]interface{}) {
-		md := disk.(map[string]interface{})
-		mDisks = append(mDisks, md["id"].(string))
+	for _, disk := range instance.Disks {
+		mDisks = append(mDisks, disk.ID)
 	}
 	d.Set("disks", mDisks)
 
 	//IP Addresses
 	//Similar to disks, need to pull these guys out (wew)
 	var mIps []string
-	for _, na := range instance["network_adapters"].([]interface{}) {
-		neta := na.(map[string]interface{})
-		for _, ips := range neta["ip_addresses"].([]interface{}) {
-			ip := ips.(map[string]interface{})
-			mIps = append(mIps, ip["id"].(string))
+	for _, na := range instance.NetworkAdapters {
+		for _, ip := range na.IPAddresses {
+			mIps = append(mIps, ip.ID)
 		}
 	}
 	d.Set("ip_addresses", mIps)
@@ -267,316 +372,498 @@ func resourceHypercloudInstanceRead(d *schema.ResourceData, meta interface{}) er
 	//Public Keys
 	//Again, we need to pull out the IDs
 	var mPKs []string
-	for _, pks := range instance["public_keys"].([]interface{}) {
-		pk := pks.(map[string]interface{})
-		mPKs = append(mPKs, pk["id"].(string))
+	for _, pk := range instance.PublicKeys {
+		mPKs = append(mPKs, pk.ID)
 	}
 	d.Set("public_keys", mPKs)
 
 	//How unnecessarily verbose
 
 	//Start on __x__
-	d.Set("start_on_crash", instance["start_on_crash"].(bool))
-	d.Set("start_on_reboot", instance["start_on_reboot"].(bool))
-	d.Set("start_on_shutdown", instance["start_on_shutdown"].(bool))
+	d.Set("start_on_crash", instance.StartOnCrash)
+	d.Set("start_on_reboot", instance.StartOnReboot)
+	d.Set("start_on_shutdown", instance.StartOnShutdown)
 
 	//Virtualization
-	d.Set("virtualization", instance["virtualization"].(string))
+	d.Set("virtualization", instance.Virtualization)
 
 	//Created At
-	d.Set("created_at", instance["created_at"].(string))
-	d.Set("updated_at", instance["updated_at"].(string))
+	d.Set("created_at", instance.CreatedAt)
+	d.Set("updated_at", instance.UpdatedAt)
 
-	d.SetId(instance["id"].(string))
+	d.SetId(instance.ID)
 	//We donezo 8^)
 	return nil
 }
 
-func resourceHypercloudInstanceUpdate(d *schema.ResourceData, meta interface{}) error {
+func resourceHypercloudInstanceUpdate(d *schema.ResourceData, meta interface{}) (err error) {
 	hc := hcc.ToHypercloud(meta)
+	id := d.Id()
+	updated := false
+	//Stopping, updating and starting again share the one timeout
+	deadline := time.Now().Add(d.Timeout(schema.TimeoutUpdate))
 
+	//Each call is recorded in state as soon as it succeeds, so a failure part way through
+	//leaves state matching what was actually applied
 	d.Partial(true)
-	//Lets start from the top of the round.
-	//Memory - (I: 23)
-	if d.HasChange("memory") {
-		_, n := d.GetChange("memory")
-		/* Ensure that the memory is correct */
-		_, e := memoryValidation(n, fmt.Sprintf("%d", n))
-		if e != nil && len(e) != 0 {
-			return fmt.Errorf("%d is an invalid memory amount", d.Get("memory").(int))
-		}
-		update := make(map[string]interface{})
-		update["memory"] = n
-		_, err := hc.InstanceUpdate(d.Id(), update)
-		if err != nil {
-			return fmt.Errorf("%v", err)
-		}
-		waitErr := waitInstanceUpdate(hc, d.Id(), 30) //Should be more like 10 secs
-		if waitErr != nil {
-			return fmt.Errorf("%v", waitErr)
+
+	if changed := changesNeedingStop(d); len(changed) > 0 {
+		//Not err, which the deferred start below reports through
+		instance, infoErr := hc.InstanceInfo(id)
+		if infoErr != nil {
+			return fmt.Errorf("Unable to check the power state of instance %s: \n%v", id, infoErr)
+		}
+		if instance == nil {
+			return fmt.Errorf("Unable to check the power state of instance %s: the API returned an empty response", id)
+		}
+		if instance.State != "stopped" {
+			if !d.Get("allow_stopping_for_update").(bool) {
+				return stopRequiredError(id, changed)
+			}
+			if err := stopInstance(hc, id, timeUntil(deadline)); err != nil {
+				return err
+			}
+			//Put it back how it was, even if the update fails
+			if instance.State == "running" {
+				defer func() {
+					startErr := startInstance(hc, id, timeUntil(deadline))
+					if startErr == nil {
+						return
+					}
+					startErr = fmt.Errorf("Instance %s was stopped for the update and couldn't be started again: \n%v", id, startErr)
+					if err == nil {
+						err = startErr
+					} else {
+						err = multierror.Append(err, startErr)
+					}
+				}()
+			}
+		}
+	}
+
+	//Lists each have their own endpoint
+	if d.HasChange("availability_group") {
+		group := expandStringList(d.Get("availability_group").(*schema.Set).List())
+		if _, err := hc.InstanceUpdateHighAvailability(id, group); err != nil {
+			return fmt.Errorf("Unable to update the availability group of instance %s: \n%v", id, err)
 		}
-		d.SetPartial("memory")
+		d.SetPartial("availability_group")
+		updated = true
 	}
 
-	if d.HasChange("name") {
-		_, n := d.GetChange("name")
-		update := make(map[string]interface{})
-		update["name"] = n
-		_, err := hc.InstanceUpdate(d.Id(), update)
-		if err != nil {
-			fmt.Errorf("%v", err)
-		}
-		waitErr := waitInstanceUpdate(hc, d.Id(), 30) //Should be more like 10 secs
-		if waitErr != nil {
-			fmt.Errorf("%v", waitErr)
+	if d.HasChange("disks") {
+		disks := expandStringList(d.Get("disks").([]interface{}))
+		if _, err := hc.InstanceUpdateDisks(id, disks); err != nil {
+			return fmt.Errorf("Unable to update the disks of instance %s: \n%v", id, err)
 		}
-		d.SetPartial("name")
+		d.SetPartial("disks")
+		updated = true
 	}
 
-	if d.HasChange("performance_tier") {
-		_, n := d.GetChange("performance_tier")
-		update := make(map[string]interface{})
-		update["name"] = n
-		_, err := hc.InstanceUpdate(d.Id(), update)
-		if err != nil {
-			fmt.Errorf("%v", err)
-		}
-		waitErr := waitInstanceUpdate(hc, d.Id(), 30) //Should be more like 10 secs
-		if waitErr != nil {
-			fmt.Errorf("%v", waitErr)
+	if d.HasChange("ip_addresses") {
+		adapters := []hcc.NetworkAdapterRequest{{IPAddresses: expandStringList(d.Get("ip_addresses").(*schema.Set).List())}}
+		if _, err := hc.InstanceUpdateNetworking(id, adapters); err != nil {
+			return fmt.Errorf("Unable to update the IP addresses of instance %s: \n%v", id, err)
 		}
-		d.SetPartial("performance_tier")
+		d.SetPartial("ip_addresses")
+		updated = true
 	}
 
-	if d.HasChange("region") {
-		_, n := d.GetChange("region")
-		update := make(map[string]interface{})
-		update["region"] = n
-		_, err := hc.InstanceUpdate(d.Id(), update)
-		if err != nil {
-			fmt.Errorf("%v", err)
-		}
-		waitErr := waitInstanceUpdate(hc, d.Id(), 30) //Should be more like 10 secs
-		if waitErr != nil {
-			fmt.Errorf("%v", waitErr)
+	if d.HasChange("public_keys") {
+		keys := expandStringList(d.Get("public_keys").(*schema.Set).List())
+		if _, err := hc.InstanceUpdatePublicKeys(id, keys); err != nil {
+			return fmt.Errorf("Unable to update the public keys of instance %s: \n%v", id, err)
 		}
-		d.SetPartial("region")
+		d.SetPartial("public_keys")
+		updated = true
 	}
 
-	if d.HasChange("availability_group") {
-		_, n := d.GetChange("availability_group")
-		update := make(map[string]interface{})
-		update["availability_group"] = n
-		_, err := hc.InstanceUpdate(d.Id(), update)
-		if err != nil {
-			fmt.Errorf("%v", err)
+	//Everything else goes in a single update
+	update, changed := instanceUpdateRequest(d)
+	if len(changed) > 0 {
+		if _, err := hc.InstanceUpdate(id, update); err != nil {
+			return fmt.Errorf("Unable to update %s of instance %s: \n%v", strings.Join(changed, ", "), id, err)
 		}
-		waitErr := waitInstanceUpdate(hc, d.Id(), 30) //Should be more like 10 secs
-		if waitErr != nil {
-			fmt.Errorf("%v", waitErr)
+		for _, k := range changed {
+			d.SetPartial(k)
 		}
-		d.SetPartial("availability_group")
+		updated = true
 	}
 
-	if d.HasChange("boot_device") {
-		_, n := d.GetChange("boot_device")
-		update := make(map[string]interface{})
-		update["boot_device"] = n
-		_, err := hc.InstanceUpdate(d.Id(), update)
-		if err != nil {
-			fmt.Errorf("%v", err)
-		}
-		waitErr := waitInstanceUpdate(hc, d.Id(), 30) //Should be more like 10 secs
-		if waitErr != nil {
-			fmt.Errorf("%v", waitErr)
+	if updated {
+		if err := waitInstanceUpdate(hc, id, timeUntil(deadline)); err != nil {
+			return err
 		}
-		d.SetPartial("boot_device")
 	}
+	d.Partial(false)
 
-	if d.HasChange("disks") {
-		_, n := d.GetChange("disks")
-		update := make(map[string]interface{})
-		update["disks"] = n
-		_, err := hc.InstanceUpdate(d.Id(), update)
-		if err != nil {
-			fmt.Errorf("%v", err)
-		}
-		waitErr := waitInstanceUpdate(hc, d.Id(), 30) //Should be more like 10 secs
-		if waitErr != nil {
-			fmt.Errorf("%v", waitErr)
+	instanceChanged(meta, id)
+	return resourceHypercloudInstanceRead(d, meta)
+}
+
+// Changing these is refused by the API while the instance is running
+var instanceStopRequiredAttributes = []string{"memory", "performance_tier", "virtualization"}
+
+// changesNeedingStop returns the changed attributes that can only be applied to a stopped instance
+func changesNeedingStop(d interface {
+	HasChange(string) bool
+}) (changed []string) {
+	for _, k := range instanceStopRequiredAttributes {
+		if d.HasChange(k) {
+			changed = append(changed, k)
 		}
-		d.SetPartial("disks")
 	}
+	return
+}
 
-	if d.HasChange("ip_addresses") {
-		_, n := d.GetChange("ip_addresses")
-		update := make(map[string]interface{})
-		update["ip_addresses"] = n
-		_, err := hc.InstanceUpdate(d.Id(), update)
-		if err != nil {
-			fmt.Errorf("%v", err)
-		}
-		waitErr := waitInstanceUpdate(hc, d.Id(), 30) //Should be more like 10 secs
-		if waitErr != nil {
-			fmt.Errorf("%v", waitErr)
-		}
-		d.SetPartial("ip_addresses")
+func stopRequiredError(id string, changed []string) error {
+	return fmt.Errorf("Changing %s of instance %s requires it to be stopped. Set allow_stopping_for_update = true "+
+		"to let Terraform stop it and start it again afterwards, or stop it before applying", strings.Join(changed, " and "), id)
+}
+
+// resourceHypercloudInstanceCustomizeDiff catches changes the API would refuse at plan time,
+// so they're reported before anything is changed
+func resourceHypercloudInstanceCustomizeDiff(d *schema.ResourceDiff, meta interface{}) error {
+	if err := validateInstanceReferences(d, meta); err != nil {
+		return err
 	}
+	return validateInstanceStopAllowed(d, meta)
+}
 
-	if d.HasChange("public_keys") {
-		_, n := d.GetChange("public_keys")
-		update := make(map[string]interface{})
-		update["public_keys"] = n
-		_, err := hc.InstanceUpdate(d.Id(), update)
-		if err != nil {
-			fmt.Errorf("%v", err)
-		}
-		waitErr := waitInstanceUpdate(hc, d.Id(), 30) //Should be more like 10 secs
-		if waitErr != nil {
-			fmt.Errorf("%v", waitErr)
-		}
-		d.SetPartial("public_keys")
+// validateInstanceStopAllowed fails when a change needs a running instance stopped and the user hasn't allowed it
+func validateInstanceStopAllowed(d *schema.ResourceDiff, meta interface{}) error {
+	if d.Id() == "" || d.Get("allow_stopping_for_update").(bool) {
+		return nil
+	}
+	changed := changesNeedingStop(d)
+	if len(changed) == 0 {
+		return nil
 	}
+	instance, err := instanceInfo(meta, d.Id())
+	if err != nil {
+		return fmt.Errorf("Unable to check the power state of instance %s: \n%v", d.Id(), err)
+	}
+	if instance == nil {
+		return fmt.Errorf("Unable to check the power state of instance %s: the API returned an empty response", d.Id())
+	}
+	if instance.State != "stopped" {
+		return stopRequiredError(d.Id(), changed)
+	}
+	return nil
+}
 
-	if d.HasChange("start_on_crash") {
-		_, n := d.GetChange("start_on_crash")
-		update := make(map[string]interface{})
-		update["start_on_crash"] = n
-		_, err := hc.InstanceUpdate(d.Id(), update)
-		if err != nil {
-			fmt.Errorf("%v", err)
-		}
-		waitErr := waitInstanceUpdate(hc, d.Id(), 30) //Should be more like 10 secs
-		if waitErr != nil {
-			fmt.Errorf("%v", waitErr)
+// validateInstanceReferences checks memory fits the performance tier, and that the disks and IP
+// addresses exist in the instance's region and the public keys exist. Every problem is reported
+func validateInstanceReferences(d *schema.ResourceDiff, meta interface{}) error {
+	hc := hcc.ToHypercloud(meta)
+	var errs *multierror.Error
+
+	if d.HasChange("memory") || d.HasChange("performance_tier") {
+		if tierID := d.Get("performance_tier").(string); isKnown(tierID) {
+			if err := validateInstanceMemory(hc, tierID, d.Get("memory").(int)); err != nil {
+				errs = multierror.Append(errs, err)
+			}
 		}
-		d.SetPartial("start_on_crash")
 	}
 
-	if d.HasChange("start_on_reboot") {
-		_, n := d.GetChange("start_on_reboot")
-		update := make(map[string]interface{})
-		update["start_on_reboot"] = n
-		_, err := hc.InstanceUpdate(d.Id(), update)
-		if err != nil {
-			fmt.Errorf("%v", err)
-		}
-		waitErr := waitInstanceUpdate(hc, d.Id(), 30) //Should be more like 10 secs
-		if waitErr != nil {
-			fmt.Errorf("%v", waitErr)
+	if !d.HasChange("disks") && !d.HasChange("ip_addresses") && !d.HasChange("public_keys") {
+		return errs.ErrorOrNil()
+	}
+
+	//Regions are only compared when the instance's is known. One that's left to the provider or comes from
+	//a resource that's yet to be created reads the same at plan time, so neither is guessed at
+	region := ""
+	if _, ok := d.GetOk("region"); ok {
+		var err error
+		if region, err = getRegion(d, meta); err != nil {
+			return multierror.Append(errs, err)
 		}
-		d.SetPartial("start_on_reboot")
 	}
 
-	if d.HasChange("start_on_shutdown") {
-		_, n := d.GetChange("start_on_shutdown")
-		update := make(map[string]interface{})
-		update["start_on_shutdown"] = n
-		_, err := hc.InstanceUpdate(d.Id(), update)
-		if err != nil {
-			fmt.Errorf("%v", err)
+	if d.HasChange("disks") {
+		for _, id := range expandStringList(d.Get("disks").([]interface{})) {
+			if !isKnown(id) {
+				continue
+			}
+			disk, err := hc.DiskInfo(id)
+			switch {
+			case hcc.IsNotFound(err):
+				errs = multierror.Append(errs, fmt.Errorf("Disk %s doesn't exist", id))
+			case err != nil:
+				errs = multierror.Append(errs, fmt.Errorf("Unable to check disk %s: \n%v", id, err))
+			case disk == nil:
+				errs = multierror.Append(errs, fmt.Errorf("Unable to check disk %s: the API returned an empty response", id))
+			case region != "" && disk.Region != nil && disk.Region.ID != region:
+				errs = multierror.Append(errs, fmt.Errorf("Disk %s is in region %s, not the instance's region %s", id, disk.Region.ID, region))
+			}
 		}
-		waitErr := waitInstanceUpdate(hc, d.Id(), 30) //Should be more like 10 secs
-		if waitErr != nil {
-			fmt.Errorf("%v", waitErr)
+	}
+
+	if d.HasChange("ip_addresses") {
+		for _, id := range expandStringList(d.Get("ip_addresses").(*schema.Set).List()) {
+			if !isKnown(id) {
+				continue
+			}
+			ip, err := hc.IPAddressInfo(id)
+			switch {
+			case hcc.IsNotFound(err):
+				errs = multierror.Append(errs, fmt.Errorf("IP address %s doesn't exist", id))
+			case err != nil:
+				errs = multierror.Append(errs, fmt.Errorf("Unable to check IP address %s: \n%v", id, err))
+			case ip == nil:
+				errs = multierror.Append(errs, fmt.Errorf("Unable to check IP address %s: the API returned an empty response", id))
+			case region != "" && ip.Region != nil && ip.Region.ID != region:
+				errs = multierror.Append(errs, fmt.Errorf("IP address %s (%s) is in region %s, not the instance's region %s", id, ip.Address, ip.Region.ID, region))
+			}
 		}
-		d.SetPartial("start_on_shutdown")
 	}
 
-	if d.HasChange("virtualization") {
-		_, n := d.GetChange("virtualization")
-		update := make(map[string]interface{})
-		update["virtualization"] = n
-		_, err := hc.InstanceUpdate(d.Id(), update)
-		if err != nil {
-			fmt.Errorf("%v", err)
+	if d.HasChange("public_keys") {
+		for _, id := range expandStringList(d.Get("public_keys").(*schema.Set).List()) {
+			if !isKnown(id) {
+				continue
+			}
+			_, err := hc.PublicKeyInfo(id)
+			switch {
+			case hcc.IsNotFound(err):
+				errs = multierror.Append(errs, fmt.Errorf("Public key %s doesn't exist", id))
+			case err != nil:
+				errs = multierror.Append(errs, fmt.Errorf("Unable to check public key %s: \n%v", id, err))
+			}
+		}
+	}
+	return errs.ErrorOrNil()
+}
+
+func validateInstanceMemory(hc hcc.Client, tierID string, memory int) error {
+	tiers, err := hc.PerformanceTierListInstance()
+	if err != nil {
+		return fmt.Errorf("Unable to check memory against performance tier %s: \n%v", tierID, err)
+	}
+	for _, tier := range tiers {
+		if tier.ID != tierID {
+			continue
+		}
+		if tier.MinMemory > 0 && memory < tier.MinMemory {
+			return fmt.Errorf("Memory %d is below the minimum of %d for performance tier %s", memory, tier.MinMemory, tier.Name)
 		}
-		waitErr := waitInstanceUpdate(hc, d.Id(), 30) //Should be more like 10 secs
-		if waitErr != nil {
-			fmt.Errorf("%v", waitErr)
+		if tier.MaxMemory > 0 && memory > tier.MaxMemory {
+			return fmt.Errorf("Memory %d is above the maximum of %d for performance tier %s", memory, tier.MaxMemory, tier.Name)
 		}
-		d.SetPartial("virtualization")
+		return nil
 	}
+	return fmt.Errorf("Performance tier %s isn't an instance performance tier", tierID)
+}
 
-	//We did it Reddit!
-	d.Partial(false)
+// isKnown reports whether a value in a plan is set, rather than empty or still to be computed
+func isKnown(v string) bool {
+	return v != "" && v != config.UnknownVariableValue
+}
 
-	return resourceHypercloudInstanceRead(d, meta)
+// instanceUpdateRequest builds an update of every changed attribute set through InstanceUpdate,
+// returning the names of those attributes
+func instanceUpdateRequest(d *schema.ResourceData) (update hcc.InstanceUpdateRequest, changed []string) {
+	if d.HasChange("name") {
+		name := d.Get("name").(string)
+		update.Name = &name
+		changed = append(changed, "name")
+	}
+	if d.HasChange("memory") {
+		memory := d.Get("memory").(int)
+		update.Memory = &memory
+		changed = append(changed, "memory")
+	}
+	if d.HasChange("performance_tier") {
+		performanceTier := d.Get("performance_tier").(string)
+		update.PerformanceTier = &performanceTier
+		changed = append(changed, "performance_tier")
+	}
+	if d.HasChange("boot_device") {
+		bootDevice := d.Get("boot_device").(string)
+		update.BootDevice = &bootDevice
+		changed = append(changed, "boot_device")
+	}
+	if d.HasChange("virtualization") {
+		virtualization := d.Get("virtualization").(string)
+		update.Virtualization = &virtualization
+		changed = append(changed, "virtualization")
+	}
+	if d.HasChange("start_on_crash") {
+		startOnCrash := d.Get("start_on_crash").(bool)
+		update.StartOnCrash = &startOnCrash
+		changed = append(changed, "start_on_crash")
+	}
+	if d.HasChange("start_on_reboot") {
+		startOnReboot := d.Get("start_on_reboot").(bool)
+		update.StartOnReboot = &startOnReboot
+		changed = append(changed, "start_on_reboot")
+	}
+	if d.HasChange("start_on_shutdown") {
+		startOnShutdown := d.Get("start_on_shutdown").(bool)
+		update.StartOnShutdown = &startOnShutdown
+		changed = append(changed, "start_on_shutdown")
+	}
+	return
 }
 
 func resourceHypercloudInstanceDelete(d *schema.ResourceData, meta interface{}) error {
 	hc := hcc.ToHypercloud(meta)
-	_, err := hc.InstanceDelete(d.Id())
-	if err != nil {
-		fmt.Errorf("%v", err)
+	id := d.Id()
+	//Already gone is as good as deleted
+	if err := hc.InstanceDelete(id); err != nil && !hcc.IsNotFound(err) {
+		return fmt.Errorf("Unable to delete instance %s: \n%v", id, err)
+	}
+	instanceChanged(meta, id)
+
+	//Stays in state until it's confirmed gone, so a failed delete can be retried
+	if err := waitInstanceTerminate(hc, id, d.Timeout(schema.TimeoutDelete)); err != nil {
+		return fmt.Errorf("Instance %s was deleted but didn't terminate: \n%v", id, err)
 	}
-	waitInstanceTerminate(hc, d.Id(), 30)
 	d.SetId("")
 	return nil
 }
 
-func resourceHypercloudInstanceExists(d *schema.ResourceData, meta interface{}) (exists bool, err error) {
+// resourceHypercloudInstanceImport accepts an instance ID or exact name. Read then fills
+// in everything, including attributes with schema defaults, from the API
+func resourceHypercloudInstanceImport(d *schema.ResourceData, meta interface{}) ([]*schema.ResourceData, error) {
 	hc := hcc.ToHypercloud(meta)
-	_, infErr := hc.InstanceInfo(d.Id())
-	if infErr == nil {
-		exists = true
-		return
+	//Not in the API, so set it here or the first plan would show it changing
+	d.Set("allow_stopping_for_update", false)
+
+	_, err := hc.InstanceInfo(d.Id())
+	if err == nil {
+		return []*schema.ResourceData{d}, nil
+	}
+	//Anything but the API not recognising the ID (an outage, bad credentials) says nothing about the name
+	if !hcc.IsNotFound(err) && !hcc.IsValidation(err) {
+		return nil, err
 	}
-	exists = false
-	return
-}
 
-func waitInstanceUp(meta interface{}, id string, timeoutS int) error {
-	hc := hcc.ToHypercloud(meta)
-	start := time.Now() //Possibly need for logging
-	end := start.Add(time.Duration(timeoutS) * time.Second)
-	for end.After(time.Now()) {
-		state, err := hc.InstanceInfo(id)
-		if err != nil {
-			return fmt.Errorf("%v", err)
-		}
-		if state.(map[string]interface{})["state"].(string) == "stopped" {
-			return nil
-		}
-		if state.(map[string]interface{})["state"].(string) != "provisioning" || state.(map[string]interface{})["state"].(string) != "initial" || state.(map[string]interface{})["state"].(string) != "pending_verification" {
-			return fmt.Errorf(state.(map[string]interface{})["state"].(string))
+	//Not an instance ID, so try it as a name
+	instances, err := hc.InstanceList()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list instances to find %q: \n%v", d.Id(), err)
+	}
+	var matches []string
+	for _, instance := range instances {
+		if instance.Name == d.Id() && instance.State != "terminated" {
+			matches = append(matches, instance.ID)
 		}
 	}
-	return fmt.Errorf("Timeout (stuck provisioning?).")
+	switch len(matches) {
+	case 0:
+		return nil, fmt.Errorf("No instance with the ID or name %q", d.Id())
+	case 1:
+		d.SetId(matches[0])
+		return []*schema.ResourceData{d}, nil
+	}
+	return nil, fmt.Errorf("%d instances are named %q (%s). Import one by its ID instead",
+		len(matches), d.Id(), strings.Join(matches, ", "))
 }
 
-func waitInstanceUpdate(meta interface{}, id string, timeoutS int) error {
-	hc := hcc.ToHypercloud(meta)
-	start := time.Now()
-	end := start.Add(time.Duration(timeoutS) * time.Second)
-	for end.After(time.Now()) {
-		state, err := hc.InstanceInfo(id)
-		if err != nil {
-			return fmt.Errorf("%v", err)
-		}
-		if state.(map[string]interface{})["state"].(string) != "updating" { //TODO: Have non-normal states also return error/their state
-			return nil
-		}
+func resourceHypercloudInstanceExists(d *schema.ResourceData, meta interface{}) (bool, error) {
+	instance, err := instanceInfo(meta, d.Id())
+	if instanceGone(instance, err) {
+		return false, nil
+	}
+	if err != nil {
+		//Anything else (an outage, expired credentials) says nothing about whether it exists
+		return false, fmt.Errorf("Unable to check instance %s exists: \n%v", d.Id(), err)
 	}
+	return true, nil
+}
 
-	return fmt.Errorf("Timed out. (resource stuck updating?)")
+// instanceGone reports whether the instance doesn't exist any more. The API keeps terminated
+// instances around for a while, but they're as gone as one that returns a 404
+func instanceGone(instance *hcc.Instance, err error) bool {
+	if err != nil {
+		return hcc.IsNotFound(err)
+	}
+	return instance != nil && instance.State == "terminated"
 }
 
-func waitInstanceTerminate(meta interface{}, id string, timeoutS int) error {
-	hc := hcc.ToHypercloud(meta)
-	start := time.Now()
-	end := start.Add(time.Duration(timeoutS) * time.Second)
-	for end.After(time.Now()) {
-		state, err := hc.InstanceInfo(id)
-		if err != nil {
-			return fmt.Errorf("%v", err)
-		}
-		state = state.(map[string]interface{})
-		state = state.(map[string]interface{})
-		if state.(map[string]interface{})["state"].(string) == "terminated" {
-			return nil
-		}
+func stopInstance(hc hcc.Client, id string, timeout time.Duration) error {
+	if _, err := hc.InstanceStop(id, nil); err != nil {
+		return fmt.Errorf("Unable to stop instance %s: \n%v", id, err)
+	}
+	_, err := hcc.WaitForInstance(hc, id, hcc.WaitOptions{
+		Pending:         []string{"running", "stopping"},
+		Target:          []string{"stopped"},
+		Failure:         instanceFailureStates,
+		Timeout:         timeout,
+		PollInterval:    instancePollInterval,
+		MaxPollInterval: instanceMaxPollInterval,
+	})
+	return err
+}
+
+// timeUntil returns the time left before deadline for a wait. A wait with no timeout is unbounded,
+// so once the deadline has passed this is the shortest timeout there is rather than 0
+func timeUntil(deadline time.Time) time.Duration {
+	if left := time.Until(deadline); left > 0 {
+		return left
 	}
+	return time.Nanosecond
+}
+
+func startInstance(hc hcc.Client, id string, timeout time.Duration) error {
+	if _, err := hc.InstanceStart(id, nil); err != nil {
+		return fmt.Errorf("Unable to start instance %s: \n%v", id, err)
+	}
+	_, err := hcc.WaitForInstance(hc, id, hcc.WaitOptions{
+		Pending:         []string{"stopped", "starting"},
+		Target:          []string{"running"},
+		Failure:         instanceFailureStates,
+		Timeout:         timeout,
+		PollInterval:    instancePollInterval,
+		MaxPollInterval: instanceMaxPollInterval,
+	})
+	return err
+}
+
+// Instance states a wait moves through, and ends on if something went wrong
+var (
+	instanceProvisioningStates = []string{"initial", "provisioning", "pending_verification"}
+	instanceFailureStates      = []string{"error", "failed"}
+)
+
+// How often the waits poll the instance, backing off up to the max
+const (
+	instancePollInterval    = 2 * time.Second
+	instanceMaxPollInterval = 15 * time.Second
+)
+
+func waitInstanceUp(hc hcc.Client, id string, timeout time.Duration) error {
+	_, err := hcc.WaitForInstance(hc, id, hcc.WaitOptions{
+		Pending:         instanceProvisioningStates,
+		Target:          []string{"stopped"},
+		Failure:         instanceFailureStates,
+		Timeout:         timeout,
+		PollInterval:    instancePollInterval,
+		MaxPollInterval: instanceMaxPollInterval,
+	})
+	return err
+}
+
+func waitInstanceUpdate(hc hcc.Client, id string, timeout time.Duration) error {
+	_, err := hcc.WaitForInstance(hc, id, hcc.WaitOptions{
+		Pending:         []string{"updating"},
+		Failure:         instanceFailureStates,
+		Timeout:         timeout,
+		PollInterval:    instancePollInterval,
+		MaxPollInterval: instanceMaxPollInterval,
+	})
+	return err
+}
 
-	return fmt.Errorf("Timed out on terminate.")
+func waitInstanceTerminate(hc hcc.Client, id string, timeout time.Duration) error {
+	_, err := hcc.WaitForInstance(hc, id, hcc.WaitOptions{
+		Target:          []string{"terminated"},
+		Failure:         instanceFailureStates,
+		TargetNotFound:  true,
+		Timeout:         timeout,
+		PollInterval:    instancePollInterval,
+		MaxPollInterval: instanceMaxPollInterval,
+	})
+	return err
 }
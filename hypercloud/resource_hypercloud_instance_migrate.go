@@ -0,0 +1,60 @@
+package hypercloud
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+
+	"github.com/hashicorp/terraform/helper/hashcode"
+	"github.com/hashicorp/terraform/terraform"
+)
+
+// Instance attributes that were lists before schema version 2
+var instanceSetAttributes = []string{"availability_group", "ip_addresses", "public_keys"}
+
+func resourceHypercloudInstanceMigrateState(v int, is *terraform.InstanceState, meta interface{}) (*terraform.InstanceState, error) {
+	switch v {
+	case 0, 1:
+		//Versions 0 and 1 only differ in the API version, not in how state is stored
+		log.Printf("[INFO] Migrating HyperCloud instance state from v%d to v2", v)
+		return migrateInstanceStateV1toV2(is)
+	default:
+		return is, fmt.Errorf("Unexpected schema version: %d", v)
+	}
+}
+
+// migrateInstanceStateV1toV2 re-keys the list attributes that became sets by the hash of each element
+func migrateInstanceStateV1toV2(is *terraform.InstanceState) (*terraform.InstanceState, error) {
+	if is.Empty() || is.Attributes == nil {
+		log.Println("[DEBUG] Empty InstanceState; nothing to migrate.")
+		return is, nil
+	}
+	log.Printf("[DEBUG] Attributes before migration: %#v", is.Attributes)
+
+	for _, k := range instanceSetAttributes {
+		prefix := k + "."
+		var keys []string
+		for ak := range is.Attributes {
+			if strings.HasPrefix(ak, prefix) && ak != prefix+"#" {
+				keys = append(keys, ak)
+			}
+		}
+		if len(keys) == 0 {
+			continue
+		}
+		values := make(map[string]bool, len(keys))
+		for _, ak := range keys {
+			values[is.Attributes[ak]] = true
+			delete(is.Attributes, ak)
+		}
+		//Duplicates in the list are a single set element
+		for v := range values {
+			is.Attributes[prefix+strconv.Itoa(hashcode.String(v))] = v
+		}
+		is.Attributes[prefix+"#"] = strconv.Itoa(len(values))
+	}
+
+	log.Printf("[DEBUG] Attributes after migration: %#v", is.Attributes)
+	return is, nil
+}
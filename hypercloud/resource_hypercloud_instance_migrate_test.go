@@ -0,0 +1,89 @@
+package hypercloud
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/hashicorp/terraform/terraform"
+)
+
+func TestResourceHypercloudInstanceMigrateState(t *testing.T) {
+	cases := map[string]struct {
+		StateVersion int
+		Attributes   map[string]string
+		Expected     map[string]string
+	}{
+		"v1 lists become sets": {
+			StateVersion: 1,
+			Attributes: map[string]string{
+				"name":                 "fake",
+				"disks.#":              "2",
+				"disks.0":              "disk-1",
+				"disks.1":              "disk-2",
+				"ip_addresses.#":       "1",
+				"ip_addresses.0":       "ip-1",
+				"public_keys.#":        "2",
+				"public_keys.0":        "key-1",
+				"public_keys.1":        "key-2",
+				"availability_group.#": "0",
+			},
+			Expected: map[string]string{
+				"name":                    "fake",
+				"disks.#":                 "2",
+				"disks.0":                 "disk-1",
+				"disks.1":                 "disk-2",
+				"ip_addresses.#":          "1",
+				"ip_addresses.1114592528": "ip-1",
+				"public_keys.#":           "2",
+				"public_keys.250396538":   "key-1",
+				"public_keys.2548428480":  "key-2",
+				"availability_group.#":    "0",
+			},
+		},
+		"v0 duplicates collapse": {
+			StateVersion: 0,
+			Attributes: map[string]string{
+				"public_keys.#": "2",
+				"public_keys.0": "key-1",
+				"public_keys.1": "key-1",
+			},
+			Expected: map[string]string{
+				"public_keys.#":         "1",
+				"public_keys.250396538": "key-1",
+			},
+		},
+	}
+
+	for tn, tc := range cases {
+		is := &terraform.InstanceState{
+			ID:         "instance-1",
+			Attributes: tc.Attributes,
+		}
+		is, err := resourceHypercloudInstanceMigrateState(tc.StateVersion, is, nil)
+		if err != nil {
+			t.Fatalf("%s: bad: %s", tn, err)
+		}
+		if !reflect.DeepEqual(is.Attributes, tc.Expected) {
+			t.Fatalf("%s: expected %v, got %v", tn, tc.Expected, is.Attributes)
+		}
+	}
+}
+
+func TestResourceHypercloudInstanceMigrateState_empty(t *testing.T) {
+	var is *terraform.InstanceState
+
+	//Should handle nil
+	is, err := resourceHypercloudInstanceMigrateState(1, is, nil)
+	if err != nil {
+		t.Fatalf("err: %#v", err)
+	}
+	if is != nil {
+		t.Fatalf("expected nil instancestate, got: %#v", is)
+	}
+
+	//Should handle non-nil but empty
+	is = &terraform.InstanceState{}
+	if _, err := resourceHypercloudInstanceMigrateState(1, is, nil); err != nil {
+		t.Fatalf("err: %#v", err)
+	}
+}
@@ -2,10 +2,14 @@ package hypercloud
 
 import (
 	"fmt"
+	"strings"
 	"testing"
+	"time"
 
+	"github.com/hashicorp/terraform/config"
 	"github.com/hashicorp/terraform/helper/acctest"
 	"github.com/hashicorp/terraform/helper/resource"
+	"github.com/hashicorp/terraform/helper/schema"
 	"github.com/hashicorp/terraform/terraform"
 
 	hcc "github.com/TheHyperCloud/hypercloud-go-client/hypercloud"
@@ -16,7 +20,7 @@ func TestResourceHypercloudInstance_basic(t *testing.T) {
 	t.Parallel()
 
 	var name = fmt.Sprintf("terraform-instance-test-%s", acctest.RandString(10))
-	var instance map[string]interface{}
+	var instance hcc.Instance
 
 	resource.Test(t, resource.TestCase{
 		PreCheck:     func() { testAccPreCheck(t) },
@@ -37,6 +41,660 @@ func TestResourceHypercloudInstance_basic(t *testing.T) {
 	})
 }
 
+// Runs the instance through create, update and destroy against the in-memory fake
+func TestResourceHypercloudInstance_fake(t *testing.T) {
+	hc, r, raw, state := testFakeInstance(t, map[string]interface{}{
+		"disks": []interface{}{"disk-1", "disk-2"},
+	})
+	var err error
+	instance, ok := hc.instances[state.ID]
+	if !ok {
+		t.Fatalf("Instance %q wasn't created, have %v", state.ID, hc.instances)
+	}
+	if instance.Region.ID != "9e9806d3-d542-4ef0-878a-588c49ffcf50" {
+		t.Fatalf("Expected the provider's default region to be resolved to its ID, got %q", instance.Region.ID)
+	}
+	if state.Attributes["region"] != instance.Region.ID || state.Attributes["disks.1"] != "disk-2" {
+		t.Fatalf("State doesn't match the instance: %v", state.Attributes)
+	}
+
+	raw["memory"] = 8192
+	raw["name"] = "renamed"
+	raw["boot_device"] = "network"
+	raw["disks"] = []interface{}{"disk-2"}
+	hc.calls = nil
+	state, err = testResourceApply(t, r, state, raw, hc)
+	if err != nil {
+		t.Fatalf("Update failed: %s", err)
+	}
+	if instance.Memory != 8192 || instance.Name != "renamed" || instance.BootDevice != "network" || len(instance.Disks) != 1 {
+		t.Fatalf("Instance wasn't updated: %+v", instance)
+	}
+	if state.Attributes["memory"] != "8192" || state.Attributes["name"] != "renamed" || state.Attributes["disks.#"] != "1" {
+		t.Fatalf("State wasn't updated: %v", state.Attributes)
+	}
+	if expected := fmt.Sprintf("[InstanceUpdateDisks %[1]s InstanceUpdate %[1]s]", state.ID); fmt.Sprint(hc.calls) != expected {
+		t.Fatalf("Expected calls %s, got %v", expected, hc.calls)
+	}
+
+	if _, err = testResourceDestroy(r, state, hc); err != nil {
+		t.Fatalf("Delete failed: %s", err)
+	}
+	if instance.State != "terminated" {
+		t.Fatalf("Instance wasn't deleted, state %q", instance.State)
+	}
+}
+
+// A create that timed out before Terraform saw the ID leaves an instance behind. The next attempt should use it
+func TestResourceHypercloudInstance_fakeOrphan(t *testing.T) {
+	hc := newFakeClient()
+	hc.createState = "provisioning"
+	hc.readyOnInfo = true
+	r := resourceHypercloudInstance()
+	raw := map[string]interface{}{
+		"memory":           4096,
+		"name":             "fake",
+		"performance_tier": "55f841d6-7e19-4de9-be47-93f650ff9f9b",
+	}
+
+	//The API creates the instance but the response never arrives
+	hc.failures = map[string]error{"InstanceAssemble": &hcc.TransportError{Method: "POST", URL: "/api/v1/instances", Err: fmt.Errorf("timeout awaiting response headers")}}
+	if _, err := testResourceApply(t, r, nil, raw, hc); err == nil {
+		t.Fatalf("Expected the create to fail")
+	}
+	orphan := hc.instances["instance-1"]
+	hc.failures = nil
+	//Same name but not created from this config
+	hc.instances["other"] = &hcc.Instance{ID: "other", Name: "fake", State: "provisioning", CreatedAt: orphan.CreatedAt}
+
+	hc.calls = nil
+	state, err := testResourceApply(t, r, nil, raw, hc)
+	if err != nil {
+		t.Fatalf("Create failed: %s", err)
+	}
+	if state.ID != orphan.ID {
+		t.Fatalf("Expected the orphaned instance %s to be used, got %s", orphan.ID, state.ID)
+	}
+	if len(hc.calls) != 0 {
+		t.Fatalf("Expected no second create, got %v", hc.calls)
+	}
+
+	//Once it's provisioned it may be another resource's, so it's no longer a candidate
+	state, err = testResourceApply(t, r, nil, raw, hc)
+	if err != nil {
+		t.Fatalf("Create failed: %s", err)
+	}
+	if state.ID == orphan.ID || state.ID == "other" {
+		t.Fatalf("Expected a new instance, got %s", state.ID)
+	}
+
+	//Nor is one older than the create timeout
+	hc.failures = map[string]error{"InstanceAssemble": &hcc.TransportError{Method: "POST", URL: "/api/v1/instances", Err: fmt.Errorf("timeout awaiting response headers")}}
+	testResourceApply(t, r, nil, raw, hc)
+	hc.failures = nil
+	stale := hc.instances[fmt.Sprintf("instance-%d", hc.nextID)]
+	stale.CreatedAt = time.Now().Add(-time.Hour).UTC().Format(time.RFC3339)
+	state, err = testResourceApply(t, r, nil, raw, hc)
+	if err != nil {
+		t.Fatalf("Create failed: %s", err)
+	}
+	if state.ID == stale.ID {
+		t.Fatalf("Expected an instance created an hour ago not to be adopted")
+	}
+}
+
+// Resources with identical config mustn't adopt each other's instances
+func TestResourceHypercloudInstance_fakeIdenticalResources(t *testing.T) {
+	hc := newFakeClient()
+	meta := &providerMeta{Client: hc, claims: newInstanceClaims()}
+	r := resourceHypercloudInstance()
+	raw := map[string]interface{}{
+		"memory":           4096,
+		"name":             "web",
+		"performance_tier": "55f841d6-7e19-4de9-be47-93f650ff9f9b",
+	}
+
+	first, err := testResourceApply(t, r, nil, raw, meta)
+	if err != nil {
+		t.Fatalf("Create failed: %s", err)
+	}
+	second, err := testResourceApply(t, r, nil, raw, meta)
+	if err != nil {
+		t.Fatalf("Create failed: %s", err)
+	}
+	if first.ID == second.ID || len(hc.instances) != 2 {
+		t.Fatalf("Expected each resource to get its own instance, got %s and %s", first.ID, second.ID)
+	}
+
+	//One still provisioning from a create in progress is claimed by that create
+	hc.createState = "provisioning"
+	req := hcc.InstanceCreateRequest{Name: "db", Memory: 4096}
+	var ids []string
+	for i := 0; i < 2; i++ {
+		instance, err := assembleInstance(meta, req, time.Hour)
+		if err != nil {
+			t.Fatalf("Create failed: %s", err)
+		}
+		ids = append(ids, instance.ID)
+	}
+	if ids[0] == ids[1] {
+		t.Fatalf("Expected the second create not to adopt %s", ids[0])
+	}
+}
+
+func TestResourceHypercloudInstance_fakeBulkRefresh(t *testing.T) {
+	hc := newFakeClient()
+	r := resourceHypercloudInstance()
+
+	var states []*terraform.InstanceState
+	for i := 0; i < 3; i++ {
+		state, err := testResourceApply(t, r, nil, map[string]interface{}{
+			"memory":           4096,
+			"name":             fmt.Sprintf("fake-%d", i),
+			"performance_tier": "55f841d6-7e19-4de9-be47-93f650ff9f9b",
+		}, hc)
+		if err != nil {
+			t.Fatalf("Create failed: %s", err)
+		}
+		states = append(states, state)
+	}
+
+	meta := &providerMeta{Client: hc, instances: newInstanceSnapshot(time.Minute)}
+	hc.infoCalls, hc.listCalls = 0, 0
+	for _, state := range states {
+		refreshed, err := r.Refresh(state, meta)
+		if err != nil {
+			t.Fatalf("Refresh of %s failed: %s", state.ID, err)
+		}
+		if refreshed == nil || refreshed.Attributes["name"] != hc.instances[state.ID].Name {
+			t.Fatalf("Refresh of %s didn't match the instance: %v", state.ID, refreshed)
+		}
+	}
+	//Missing from the list, so looked up to be sure
+	if refreshed, err := r.Refresh(&terraform.InstanceState{ID: "gone"}, meta); err != nil || refreshed != nil {
+		t.Fatalf("Expected a missing instance to be removed, got %v, %v", refreshed, err)
+	}
+	if hc.listCalls != 1 || hc.infoCalls != 1 {
+		t.Fatalf("Expected a single list and one lookup, got %d lists and %d lookups", hc.listCalls, hc.infoCalls)
+	}
+
+	//Changed by the provider since the snapshot was taken, so it's out of date
+	hc.instances[states[0].ID].Name = "renamed"
+	instanceChanged(meta, states[0].ID)
+	refreshed, err := r.Refresh(states[0], meta)
+	if err != nil || refreshed.Attributes["name"] != "renamed" {
+		t.Fatalf("Expected the changed instance to be looked up, got %v, %v", refreshed, err)
+	}
+	if hc.listCalls != 1 {
+		t.Fatalf("Expected the snapshot to be reused, got %d lists", hc.listCalls)
+	}
+}
+
+func TestResourceHypercloudInstance_fakeImport(t *testing.T) {
+	hc := newFakeClient()
+	r := resourceHypercloudInstance()
+	existing := hcc.Instance{
+		ID:              "existing",
+		Name:            "built-by-hand",
+		State:           "stopped",
+		Memory:          2048,
+		BootDevice:      "cdrom",
+		Virtualization:  "pv",
+		StartOnCrash:    false,
+		StartOnReboot:   true,
+		StartOnShutdown: true,
+		PerformanceTier: &hcc.PerformanceTier{ID: "55f841d6-7e19-4de9-be47-93f650ff9f9b"},
+		Region:          &hc.regions[0],
+		Disks:           []hcc.Disk{{ID: "disk-1"}},
+	}
+	hc.instances[existing.ID] = &existing
+	hc.instances["twin-1"] = &hcc.Instance{ID: "twin-1", Name: "twin", State: "stopped"}
+	hc.instances["twin-2"] = &hcc.Instance{ID: "twin-2", Name: "twin", State: "stopped"}
+	hc.instances["old"] = &hcc.Instance{ID: "old", Name: "built-by-hand", State: "terminated"}
+
+	for _, id := range []string{"existing", "built-by-hand"} {
+		imported, err := r.Importer.State(r.Data(&terraform.InstanceState{ID: id}), hc)
+		if err != nil {
+			t.Fatalf("Import of %s failed: %s", id, err)
+		}
+		state, err := r.Refresh(imported[0].State(), hc)
+		if err != nil {
+			t.Fatalf("Refresh of %s failed: %s", id, err)
+		}
+		if state.ID != "existing" {
+			t.Fatalf("Expected %s to import instance existing, got %s", id, state.ID)
+		}
+
+		//Matches the instance, leaving out what the API says anyway
+		c, _ := config.NewRawConfig(map[string]interface{}{
+			"memory":            2048,
+			"name":              "built-by-hand",
+			"performance_tier":  "55f841d6-7e19-4de9-be47-93f650ff9f9b",
+			"region":            "sy3",
+			"boot_device":       "cdrom",
+			"virtualization":    "pv",
+			"start_on_crash":    false,
+			"start_on_shutdown": true,
+			"disks":             []interface{}{"disk-1"},
+		})
+		diff, err := r.Diff(state, terraform.NewResourceConfig(c), hc)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		if !diff.Empty() {
+			t.Fatalf("Expected no changes after importing %s, got %v", id, diff)
+		}
+	}
+
+	for id, errPart := range map[string]string{
+		"twin":    "2 instances are named \"twin\"",
+		"missing": "No instance with the ID or name \"missing\"",
+	} {
+		_, err := r.Importer.State(r.Data(&terraform.InstanceState{ID: id}), hc)
+		if err == nil || !strings.Contains(err.Error(), errPart) {
+			t.Fatalf("Expected importing %s to fail with %q, got %v", id, errPart, err)
+		}
+	}
+
+	//An outage isn't a reason to look the ID up as a name
+	outage := &hcc.APIError{StatusCode: 503, Method: "GET", Path: "/api/v1/instances/instance-1"}
+	hc.failures = map[string]error{"InstanceInfo": outage}
+	hc.listCalls = 0
+	if _, err := r.Importer.State(r.Data(&terraform.InstanceState{ID: "instance-1"}), hc); err != outage || hc.listCalls != 0 {
+		t.Fatalf("Expected the outage to be returned as it is, got %v after %d lists", err, hc.listCalls)
+	}
+}
+
+func TestResourceHypercloudInstance_fakeTimeouts(t *testing.T) {
+	hc := newFakeClient()
+	hc.createState = "provisioning"
+	r := resourceHypercloudInstance()
+
+	start := time.Now()
+	_, err := testResourceApply(t, r, nil, map[string]interface{}{
+		"memory":           4096,
+		"name":             "slow",
+		"performance_tier": "55f841d6-7e19-4de9-be47-93f650ff9f9b",
+		"timeouts": []map[string]interface{}{
+			{"create": "100ms"},
+		},
+	}, hc)
+	if err == nil || !strings.Contains(err.Error(), "Timed out after 100ms waiting for instance instance-1") {
+		t.Fatalf("Expected the create timeout to be used, got %v", err)
+	}
+	if time.Since(start) > 5*time.Second {
+		t.Fatalf("Create took %s to time out", time.Since(start))
+	}
+}
+
+// A failed update should leave state holding what was applied before it failed, and nothing after
+func TestResourceHypercloudInstance_fakePartialUpdate(t *testing.T) {
+	hc, r, raw, state := testFakeInstance(t, nil)
+	var err error
+
+	hc.failures = map[string]error{
+		"InstanceUpdatePublicKeys": &hcc.APIError{StatusCode: 422, Method: "PUT", Path: "/instances/x/public_keys"},
+	}
+	raw["name"] = "renamed"
+	raw["disks"] = []interface{}{"disk-1"}
+	raw["public_keys"] = []interface{}{"key-1"}
+	state, err = testResourceApply(t, r, state, raw, hc)
+	if err == nil || !strings.Contains(err.Error(), "Unable to update the public keys") {
+		t.Fatalf("Expected the public key update to fail, got %v", err)
+	}
+	if state.Attributes["disks.0"] != "disk-1" {
+		t.Fatalf("Expected the disks applied before the failure to be in state: %v", state.Attributes)
+	}
+	if state.Attributes["public_keys.#"] == "1" || state.Attributes["name"] != "fake" {
+		t.Fatalf("Expected nothing from the failure on to be in state: %v", state.Attributes)
+	}
+}
+
+func TestResourceHypercloudInstance_fakeStoppingForUpdate(t *testing.T) {
+	hc, r, raw, state := testFakeInstance(t, nil)
+	var err error
+	instance := hc.instances[state.ID]
+	instance.State = "running"
+
+	//Not allowed, so the plan fails
+	raw["memory"] = 8192
+	_, err = testResourceApply(t, r, state, raw, hc)
+	if err == nil || !strings.Contains(err.Error(), "Changing memory of instance "+state.ID+" requires it to be stopped") {
+		t.Fatalf("Expected the plan to say the instance must be stopped, got %v", err)
+	}
+
+	//Changes that don't need it stopped go ahead
+	raw["memory"] = 4096
+	raw["name"] = "renamed"
+	hc.calls = nil
+	if state, err = testResourceApply(t, r, state, raw, hc); err != nil {
+		t.Fatalf("Update failed: %s", err)
+	}
+	if fmt.Sprint(hc.calls) != "[InstanceUpdate "+state.ID+"]" {
+		t.Fatalf("Expected the instance to be updated without stopping, got %v", hc.calls)
+	}
+
+	raw["memory"] = 8192
+	raw["allow_stopping_for_update"] = true
+
+	//Nothing was applied, so nothing changes in state
+	hc.failures = map[string]error{"InstanceStop": &hcc.APIError{StatusCode: 500, Method: "POST", Path: "/instances/x/stop"}}
+	failed, err := testResourceApply(t, r, state, raw, hc)
+	if err == nil {
+		t.Fatalf("Expected the failed stop to be reported")
+	}
+	if failed.Attributes["memory"] != "4096" || failed.Attributes["name"] != "renamed" {
+		t.Fatalf("Expected state to be unchanged after a failed stop, got %v", failed.Attributes)
+	}
+
+	//The update was applied, but the instance is left stopped
+	hc.failures = map[string]error{"InstanceStart": &hcc.APIError{StatusCode: 500, Method: "POST", Path: "/instances/x/start"}}
+	failed, err = testResourceApply(t, r, state, raw, hc)
+	if err == nil || instance.State != "stopped" {
+		t.Fatalf("Expected the failed start to be reported, got %v with the instance %s", err, instance.State)
+	}
+	if failed.Attributes["memory"] != "8192" {
+		t.Fatalf("Expected the applied memory in state, got %v", failed.Attributes)
+	}
+	instance.Memory = 4096
+	instance.State = "running"
+
+	//Both failures are reported, so the user knows the instance was left stopped
+	hc.failures = map[string]error{
+		"InstanceUpdate": &hcc.APIError{StatusCode: 500, Method: "PATCH", Path: "/instances/x"},
+		"InstanceStart":  &hcc.APIError{StatusCode: 503, Method: "POST", Path: "/instances/x/start"},
+	}
+	_, err = testResourceApply(t, r, state, raw, hc)
+	for _, expected := range []string{"Unable to update memory of instance " + state.ID, "was stopped for the update and couldn't be started again"} {
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Fatalf("Expected the error to contain %q, got %v", expected, err)
+		}
+	}
+	hc.failures = nil
+	instance.State = "running"
+
+	hc.calls = nil
+	if state, err = testResourceApply(t, r, state, raw, hc); err != nil {
+		t.Fatalf("Update failed: %s", err)
+	}
+	if expected := fmt.Sprintf("[InstanceStop %[1]s InstanceUpdate %[1]s InstanceStart %[1]s]", state.ID); fmt.Sprint(hc.calls) != expected {
+		t.Fatalf("Expected calls %s, got %v", expected, hc.calls)
+	}
+	if instance.Memory != 8192 || instance.State != "running" {
+		t.Fatalf("Expected the instance to be updated and running again, got %+v", instance)
+	}
+
+	//A stopped instance is left stopped
+	instance.State = "stopped"
+	raw["memory"] = 4096
+	hc.calls = nil
+	if state, err = testResourceApply(t, r, state, raw, hc); err != nil {
+		t.Fatalf("Update failed: %s", err)
+	}
+	if fmt.Sprint(hc.calls) != "[InstanceUpdate "+state.ID+"]" || instance.State != "stopped" {
+		t.Fatalf("Expected a stopped instance to be updated as it is, got %v and %s", hc.calls, instance.State)
+	}
+}
+
+func TestResourceHypercloudInstance_fakePerformanceTier(t *testing.T) {
+	hc, r, raw, state := testFakeInstance(t, nil)
+	hc.tiers = append(hc.tiers, hcc.PerformanceTier{ID: "premium", Name: "Premium", MinMemory: 2048, MaxMemory: 65536})
+	var err error
+	id := state.ID
+	instance := hc.instances[id]
+	instance.State = "running"
+
+	raw["performance_tier"] = "premium"
+	_, err = testResourceApply(t, r, state, raw, hc)
+	if err == nil || !strings.Contains(err.Error(), "Changing performance_tier of instance "+id+" requires it to be stopped") {
+		t.Fatalf("Expected the plan to say the instance must be stopped, got %v", err)
+	}
+
+	raw["allow_stopping_for_update"] = true
+	hc.calls = nil
+	if state, err = testResourceApply(t, r, state, raw, hc); err != nil {
+		t.Fatalf("Update failed: %s", err)
+	}
+	if state.ID != id || hc.instances[id] != instance {
+		t.Fatalf("Expected the tier to be changed in place, got instance %s", state.ID)
+	}
+	if expected := fmt.Sprintf("[InstanceStop %[1]s InstanceUpdate %[1]s InstanceStart %[1]s]", id); fmt.Sprint(hc.calls) != expected {
+		t.Fatalf("Expected calls %s, got %v", expected, hc.calls)
+	}
+	if instance.PerformanceTier.ID != "premium" || instance.Name != "fake" || instance.State != "running" {
+		t.Fatalf("Expected only the tier to change and the instance to be running again, got %+v", instance)
+	}
+	if state.Attributes["performance_tier"] != "premium" {
+		t.Fatalf("Expected the new tier in state, got %v", state.Attributes)
+	}
+}
+
+func TestResourceHypercloudInstance_fakeValidation(t *testing.T) {
+	hc := newFakeClient()
+	hc.disks["disk-sv2"] = &hcc.Disk{ID: "disk-sv2", Region: &hcc.Region{ID: "sv2-id", Code: "SV2"}}
+	hc.ips["ip-sv2"] = &hcc.IPAddress{ID: "ip-sv2", Address: "198.51.100.1", Region: &hcc.Region{ID: "sv2-id", Code: "SV2"}}
+	r := resourceHypercloudInstance()
+
+	_, err := testResourceApply(t, r, nil, map[string]interface{}{
+		"memory":           32768,
+		"name":             "fake",
+		"performance_tier": "55f841d6-7e19-4de9-be47-93f650ff9f9b",
+		"region":           "SY3",
+		"disks":            []interface{}{"disk-1", "disk-sv2", "disk-missing"},
+		"ip_addresses":     []interface{}{"ip-1", "ip-sv2"},
+		"public_keys":      []interface{}{"key-1", "key-missing"},
+	}, hc)
+	if err == nil {
+		t.Fatalf("Expected the plan to fail")
+	}
+	for _, expected := range []string{
+		"Memory 32768 is above the maximum of 16384 for performance tier Standard",
+		"Disk disk-sv2 is in region sv2-id, not the instance's region 9e9806d3-d542-4ef0-878a-588c49ffcf50",
+		"Disk disk-missing doesn't exist",
+		"IP address ip-sv2 (198.51.100.1) is in region sv2-id",
+		"Public key key-missing doesn't exist",
+	} {
+		if !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected the error to contain %q, got %s", expected, err)
+		}
+	}
+	for _, unexpected := range []string{"disk-1", "ip-1 ", "key-1"} {
+		if strings.Contains(err.Error(), unexpected) {
+			t.Errorf("Didn't expect the error to mention %q, got %s", unexpected, err)
+		}
+	}
+	if len(hc.calls) != 0 {
+		t.Fatalf("Expected nothing to be changed, got %v", hc.calls)
+	}
+
+	//Without a known region only existence is checked
+	for _, region := range []interface{}{nil, config.UnknownVariableValue} {
+		raw := map[string]interface{}{
+			"memory":           4096,
+			"name":             "fake",
+			"performance_tier": "55f841d6-7e19-4de9-be47-93f650ff9f9b",
+			"disks":            []interface{}{"disk-sv2", "disk-missing"},
+		}
+		if region != nil {
+			raw["region"] = region
+		}
+		c, err := config.NewRawConfig(raw)
+		if err != nil {
+			t.Fatalf("err: %s", err)
+		}
+		_, err = r.Diff(nil, terraform.NewResourceConfig(c), hc)
+		if err == nil || !strings.Contains(err.Error(), "Disk disk-missing doesn't exist") || strings.Contains(err.Error(), "disk-sv2") {
+			t.Fatalf("Expected only the missing disk to be reported with region %v, got %v", region, err)
+		}
+	}
+
+	_, err = testResourceApply(t, r, nil, map[string]interface{}{
+		"memory":           4096,
+		"name":             "fake",
+		"performance_tier": "not-a-tier",
+	}, hc)
+	if err == nil || !strings.Contains(err.Error(), "Performance tier not-a-tier isn't an instance performance tier") {
+		t.Fatalf("Expected an unknown performance tier to fail, got %v", err)
+	}
+
+	//An empty response is reported rather than read as a disk or IP address
+	hc.disks["disk-empty"] = nil
+	hc.ips["ip-empty"] = nil
+	_, err = testResourceApply(t, r, nil, map[string]interface{}{
+		"memory":           4096,
+		"name":             "fake",
+		"performance_tier": "55f841d6-7e19-4de9-be47-93f650ff9f9b",
+		"region":           "SY3",
+		"disks":            []interface{}{"disk-empty"},
+		"ip_addresses":     []interface{}{"ip-empty"},
+	}, hc)
+	for _, expected := range []string{
+		"Unable to check disk disk-empty: the API returned an empty response",
+		"Unable to check IP address ip-empty: the API returned an empty response",
+	} {
+		if err == nil || !strings.Contains(err.Error(), expected) {
+			t.Errorf("Expected the error to contain %q, got %v", expected, err)
+		}
+	}
+}
+
+func TestResourceHypercloudInstance_fakeRefreshErrors(t *testing.T) {
+	hc := newFakeClient()
+	r := resourceHypercloudInstance()
+	//Nothing nested set at all
+	hc.instances["bare"] = &hcc.Instance{ID: "bare", Name: "bare", State: "stopped"}
+	state := &terraform.InstanceState{ID: "bare"}
+
+	refreshed, err := r.Refresh(state, hc)
+	if err != nil || refreshed == nil || refreshed.Attributes["name"] != "bare" {
+		t.Fatalf("Expected an instance without nested fields to be read, got %v, %v", refreshed, err)
+	}
+
+	for _, failure := range []error{
+		&hcc.APIError{StatusCode: 500, Method: "GET", Path: "/instances/bare"},
+		&hcc.APIError{StatusCode: 401, Method: "GET", Path: "/instances/bare"},
+		&hcc.TransportError{Method: "GET", URL: "/instances/bare", Err: fmt.Errorf("connection reset")},
+	} {
+		hc.failures = map[string]error{"InstanceInfo": failure}
+		refreshed, err := r.Refresh(state, hc)
+		if err == nil || !strings.Contains(err.Error(), failure.Error()) {
+			t.Fatalf("Expected %q to be reported, got %v", failure, err)
+		}
+		if err := resourceHypercloudInstanceRead(r.Data(state), hc); err == nil {
+			t.Fatalf("Expected Read to report %q", failure)
+		}
+		if refreshed == nil {
+			t.Fatalf("Instance was removed from state after %q", failure)
+		}
+	}
+	hc.failures = nil
+
+	for _, gone := range []string{"terminated", "deleted"} {
+		if gone == "terminated" {
+			hc.instances["bare"].State = "terminated"
+		} else {
+			delete(hc.instances, "bare")
+		}
+		if refreshed, err := r.Refresh(state, hc); err != nil || refreshed != nil {
+			t.Fatalf("Expected a %s instance to be removed from state, got %v, %v", gone, refreshed, err)
+		}
+		d := r.Data(state)
+		if err := resourceHypercloudInstanceRead(d, hc); err != nil || d.Id() != "" {
+			t.Fatalf("Expected Read to remove a %s instance, got ID %q, %v", gone, d.Id(), err)
+		}
+	}
+}
+
+// An instance that never becomes ready must stay in state so it can be cleaned up
+func TestResourceHypercloudInstance_fakeCreateNeverReady(t *testing.T) {
+	for _, stuck := range []string{"provisioning", "error"} {
+		hc := newFakeClient()
+		hc.createState = stuck
+		r := resourceHypercloudInstance()
+
+		state, err := testResourceApply(t, r, nil, map[string]interface{}{
+			"memory":           4096,
+			"name":             "stuck",
+			"performance_tier": "55f841d6-7e19-4de9-be47-93f650ff9f9b",
+			"timeouts": []map[string]interface{}{
+				{"create": "50ms"},
+			},
+		}, hc)
+		if err == nil || !strings.Contains(err.Error(), "Instance instance-1 was created but didn't become ready") {
+			t.Fatalf("%s: expected the create to fail, got %v", stuck, err)
+		}
+		if state == nil || state.ID != "instance-1" {
+			t.Fatalf("%s: expected the instance to be kept in state, got %v", stuck, state)
+		}
+
+		if _, err := testResourceDestroy(r, state, hc); err != nil {
+			t.Fatalf("%s: destroy failed: %s", stuck, err)
+		}
+		if hc.instances["instance-1"].State != "terminated" {
+			t.Fatalf("%s: expected the instance to be deleted, got %+v", stuck, hc.instances["instance-1"])
+		}
+	}
+}
+
+// The API doesn't keep the order of public keys, IP addresses or the availability group
+func TestResourceHypercloudInstance_fakeUnorderedSets(t *testing.T) {
+	hc, r, raw, state := testFakeInstance(t, map[string]interface{}{
+		"public_keys": []interface{}{"key-1", "key-2"},
+	})
+	var err error
+
+	setFakePublicKeys(hc.instances[state.ID], []string{"key-2", "key-1"})
+	state, err = r.Refresh(state, hc)
+	if err != nil {
+		t.Fatalf("Refresh failed: %s", err)
+	}
+	c, err := config.NewRawConfig(raw)
+	if err != nil {
+		t.Fatalf("err: %s", err)
+	}
+	diff, err := r.Diff(state, terraform.NewResourceConfig(c), hc)
+	if err != nil {
+		t.Fatalf("Plan failed: %s", err)
+	}
+	if !diff.Empty() {
+		t.Fatalf("Expected reordered public keys not to be a change, got %v", diff)
+	}
+}
+
+func TestResourceHypercloudInstance_fakeDeleteErrors(t *testing.T) {
+	hc, r, _, state := testFakeInstance(t, nil)
+	timeout := 50 * time.Millisecond
+	destroy := &terraform.InstanceDiff{Destroy: true}
+	if err := (&schema.ResourceTimeout{Delete: &timeout}).DiffEncode(destroy); err != nil {
+		t.Fatalf("err: %s", err)
+	}
+
+	hc.failures = map[string]error{"InstanceDelete": &hcc.APIError{StatusCode: 500, Method: "DELETE", Path: "/instances/instance-1"}}
+	kept, err := r.Apply(state, destroy, hc)
+	if err == nil || !strings.Contains(err.Error(), "Unable to delete instance instance-1") {
+		t.Fatalf("Expected the delete error to be reported, got %v", err)
+	}
+	if kept == nil || kept.ID != state.ID {
+		t.Fatalf("Expected the instance to stay in state after a failed delete, got %v", kept)
+	}
+
+	hc.failures = nil
+	hc.deleteState = "stopping"
+	kept, err = r.Apply(state, destroy, hc)
+	if err == nil || !strings.Contains(err.Error(), "Instance instance-1 was deleted but didn't terminate") {
+		t.Fatalf("Expected the terminate wait to fail, got %v", err)
+	}
+	if kept == nil || kept.ID != state.ID {
+		t.Fatalf("Expected the instance to stay in state until it's terminated, got %v", kept)
+	}
+
+	//Already deleted
+	delete(hc.instances, state.ID)
+	if gone, err := r.Apply(state, destroy, hc); err != nil || gone != nil {
+		t.Fatalf("Expected deleting a missing instance to succeed, got %v, %v", gone, err)
+	}
+}
+
 func testAccInstance_basic(instance string) string {
 	return fmt.Sprintf(`
 resource "hypercloud_instance" "PotatoStomper" {
@@ -48,7 +706,7 @@ resource "hypercloud_instance" "PotatoStomper" {
 `, instance)
 }
 
-func testAccCheckInstanceExists(n string, instance *map[string]interface{}) resource.TestCheckFunc {
+func testAccCheckInstanceExists(n string, instance *hcc.Instance) resource.TestCheckFunc {
 	return func(s *terraform.State) error {
 		rs, ok := s.RootModule().Resources[n]
 		if !ok {
@@ -64,63 +722,92 @@ func testAccCheckInstanceExists(n string, instance *map[string]interface{}) reso
 			return fmt.Errorf("Failed to get instance info: \n%v", err)
 		}
 
-		if instanceInfo.(map[string]interface{})["id"] != rs.Primary.ID {
+		if instanceInfo.ID != rs.Primary.ID {
 			return fmt.Errorf("Instance not found")
 		}
-		*instance = instanceInfo.(map[string]interface{})
+		*instance = *instanceInfo
 
 		return nil
 	}
 }
 
-func testAccCheckInstanceName(instance *map[string]interface{}, name string) resource.TestCheckFunc {
+func testAccCheckInstanceName(instance *hcc.Instance, name string) resource.TestCheckFunc {
 	return func(s *terraform.State) error {
-		if (*instance)["name"].(string) != name {
-			return fmt.Errorf("Instance name %s doesn't match generated name %s", (*instance)["name"].(string), name)
+		if instance.Name != name {
+			return fmt.Errorf("Instance name %s doesn't match generated name %s", instance.Name, name)
 		}
 		return nil
 	}
 }
 
-func testAccCheckInstanceRam(instance *map[string]interface{}, ram int) resource.TestCheckFunc {
+func testAccCheckInstanceRam(instance *hcc.Instance, ram int) resource.TestCheckFunc {
 	return func(s *terraform.State) error {
-		if int((*instance)["memory"].(float64)) != ram {
-			return fmt.Errorf("Instance memory %d doesn't match provided memory %d", int((*instance)["memory"].(float64)), ram)
+		if instance.Memory != ram {
+			return fmt.Errorf("Instance memory %d doesn't match provided memory %d", instance.Memory, ram)
 		}
 		return nil
 	}
 }
 
-func testAccCheckInstancePerformanceTier(instance *map[string]interface{}, performance_tier string) resource.TestCheckFunc {
+func testAccCheckInstancePerformanceTier(instance *hcc.Instance, performance_tier string) resource.TestCheckFunc {
 	return func(s *terraform.State) error {
-		if (*instance)["performance_tier"].(map[string]interface{})["id"].(string) != performance_tier {
-			return fmt.Errorf("Instance performance_tier %s doesn't match generated performance_tier %s", (*instance)["performance_tier"].(string), performance_tier)
+		if instance.PerformanceTier == nil || instance.PerformanceTier.ID != performance_tier {
+			return fmt.Errorf("Instance performance_tier %v doesn't match generated performance_tier %s", instance.PerformanceTier, performance_tier)
 		}
 		return nil
 	}
 }
 
-func testAccCheckInstanceRegion(instance *map[string]interface{}, region string) resource.TestCheckFunc {
+func testAccCheckInstanceRegion(instance *hcc.Instance, region string) resource.TestCheckFunc {
 	return func(s *terraform.State) error {
-		if (*instance)["region"].(map[string]interface{})["id"].(string) != region {
-			return fmt.Errorf("Instance region %s doesn't match generated region %s", (*instance)["region"].(string), region)
+		if instance.Region == nil || instance.Region.ID != region {
+			return fmt.Errorf("Instance region %v doesn't match generated region %s", instance.Region, region)
 		}
 		return nil
 	}
 }
 
 func testAccCheckInstanceDestroy(s *terraform.State) error {
-	hc := hcc.ToHypercloud(testAccProvider.Meta())
+	return testCheckInstancesDestroyed(hcc.ToHypercloud(testAccProvider.Meta()), s)
+}
 
+// The API keeps terminated instances for a while, so one that's still returned counts as destroyed once terminated
+func testCheckInstancesDestroyed(hc hcc.Client, s *terraform.State) error {
 	for _, rs := range s.RootModule().Resources {
 		if rs.Type != "hypercloud_instance" {
 			continue
 		}
 
-		_, err := hc.InstanceInfo(rs.Primary.ID)
-		if err == nil {
-			return fmt.Errorf("Instance %s still exists", rs.Primary.ID)
+		instance, err := hc.InstanceInfo(rs.Primary.ID)
+		if instanceGone(instance, err) {
+			continue
 		}
+		if err != nil {
+			return fmt.Errorf("Unable to check instance %s was destroyed: %v", rs.Primary.ID, err)
+		}
+		return fmt.Errorf("Instance %s still exists", rs.Primary.ID)
 	}
 	return nil
 }
+
+func TestCheckInstancesDestroyed(t *testing.T) {
+	hc := newFakeClient()
+	hc.instances["a"] = &hcc.Instance{ID: "a", State: "terminated"}
+	s := terraform.NewState()
+	s.RootModule().Resources["hypercloud_instance.a"] = &terraform.ResourceState{
+		Type:    "hypercloud_instance",
+		Primary: &terraform.InstanceState{ID: "a"},
+	}
+
+	if err := testCheckInstancesDestroyed(hc, s); err != nil {
+		t.Fatalf("Expected a terminated instance to count as destroyed, got %s", err)
+	}
+	delete(hc.instances, "a")
+	if err := testCheckInstancesDestroyed(hc, s); err != nil {
+		t.Fatalf("Expected a deleted instance to count as destroyed, got %s", err)
+	}
+	hc.instances["a"] = &hcc.Instance{ID: "a", State: "stopped"}
+	if err := testCheckInstancesDestroyed(hc, s); err == nil || !strings.Contains(err.Error(), "Instance a still exists") {
+		t.Fatalf("Expected a stopped instance to still exist, got %v", err)
+	}
+}
@@ -0,0 +1,22 @@
+package hypercloud
+
+// expandStringList converts a schema list/set of strings into a []string for the client.
+// Always non-nil, so an empty list clears the value on update
+func expandStringList(list []interface{}) []string {
+	out := make([]string, 0, len(list))
+	for _, v := range list {
+		if s, ok := v.(string); ok {
+			out = append(out, s)
+		}
+	}
+	return out
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,5 @@
+package hypercloud
+
+// ProviderVersion is reported to the API in the User-Agent header.
+// Release builds can override it with -ldflags "-X <package path>.ProviderVersion=<version>"
+var ProviderVersion = "1.0.1"